@@ -1,11 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/patrickn2/go-image-optimizer/config"
 	"github.com/patrickn2/go-image-optimizer/handler"
 	"github.com/patrickn2/go-image-optimizer/httpserver"
 	"github.com/patrickn2/go-image-optimizer/pkg/database"
 	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress"
+	"github.com/patrickn2/go-image-optimizer/pkg/metrics"
+	"github.com/patrickn2/go-image-optimizer/pkg/safehttp"
 	"github.com/patrickn2/go-image-optimizer/repository"
 	"github.com/patrickn2/go-image-optimizer/service"
 )
@@ -16,19 +26,100 @@ func main() {
 	var db database.PkgDatabaseInterface
 	switch envs.CacheType {
 	case "file":
-		db = database.NewDatabaseFile(envs.CachePath)
+		db = database.NewDatabaseFile(envs.CachePath, envs.CacheMaxBytes, envs.CacheExpiration)
 	case "redis":
 		db = database.NewDatabaseRedis(envs.RedisHost, envs.RedisPort, envs.RedisPassword, envs.RedisDB, envs.CacheExpiration)
 	case "memcache":
 		db = database.NewDatabaseMemcache(envs.MemcacheHost, envs.MemcachePort, envs.MemcacheUser, envs.MemcachePassword, envs.CacheExpiration)
 	case "in-memory":
-		db = database.NewDatabaseInMemory(envs.CacheExpiration)
+		dbInMem := database.NewDatabaseInMemory(envs.CacheExpiration, envs.CacheMaxBytes)
+		metrics.RegisterInMemoryCache(dbInMem)
+		db = dbInMem
 	}
 
-	imageRepository := repository.NewImageRepository(db)
-	ic := imagecompress.NewImageGoVips()
-	defer ic.CloseVips()
-	imageService := service.NewImageService(ic, imageRepository)
+	imageRepository := repository.NewImageRepository(db, envs.CacheType)
+	ic := imagecompress.NewImageGoVips(imagecompress.VipsConfig{
+		Concurrency:   envs.VipsConcurrency,
+		MaxCacheFiles: envs.VipsMaxCacheFiles,
+		MaxCacheMem:   envs.VipsMaxCacheMem,
+		MaxCacheSize:  envs.VipsMaxCacheSize,
+	}, imagecompress.SourceLimits{
+		MaxPixels: envs.MaxSourcePixels,
+		MaxFrames: envs.MaxSourceFrames,
+		MaxSide:   envs.MaxSourceSide,
+	}, imagecompress.JxlOptions{
+		Effort:   envs.JxlEffort,
+		Distance: envs.JxlDistance,
+	})
+	// The output formats depend on the libraries libvips was built with
+	for _, format := range envs.FormatPreference {
+		if !ic.SupportsFormat(format) {
+			log.Fatalf("Invalid FORMAT_PREFERENCE env value: %s is not supported by libvips\n", format)
+		}
+	}
+	limiter := imagecompress.NewImageLimiter(ic, envs.ProcessingConcurrency, envs.ProcessingQueueSize, time.Duration(envs.ProcessingQueueTimeout)*time.Second)
+	httpClient := safehttp.NewClient(safehttp.Options{
+		AllowCIDRs:   envs.SsrfAllowCIDRs,
+		DenyCIDRs:    envs.SsrfDenyCIDRs,
+		MaxRedirects: envs.MaxRedirects,
+	})
+	imageService := service.NewImageService(limiter, imageRepository, httpClient)
+	metrics.RegisterCoalescing(imageService.CoalesceStats)
 	h := handler.New(imageService, envs)
-	httpserver.Start(h, envs.ApiPort, envs.ImageApiPath)
+
+	signalCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	ctx, shutdown := context.WithCancel(context.Background())
+	go func() {
+		<-signalCtx.Done()
+		// A second signal kills the process right away
+		stop()
+		// The readiness check fails while the server still accepts connections,
+		// the load balancers must notice it before the listeners are closed
+		h.Drain()
+		log.Printf("Draining, shutting down in %ds\n", envs.DrainDelay)
+		time.Sleep(time.Duration(envs.DrainDelay) * time.Second)
+		shutdown()
+	}()
+
+	if envs.MetricsPort != "" {
+		go httpserver.StartMetrics(ctx, envs.MetricsPort)
+	}
+	shutdownTimeout := time.Duration(envs.ShutdownTimeout) * time.Second
+	err := httpserver.Start(ctx, h, httpserver.Config{
+		Port:            envs.ApiPort,
+		ImagePath:       envs.ImageApiPath,
+		ReadTimeout:     time.Duration(envs.ReadTimeout) * time.Second,
+		WriteTimeout:    time.Duration(envs.WriteTimeout) * time.Second,
+		IdleTimeout:     time.Duration(envs.IdleTimeout) * time.Second,
+		ShutdownTimeout: shutdownTimeout,
+	})
+	stop()
+	shutdown()
+	exitCode := 0
+	if err != nil {
+		log.Printf("Error serving API: %v\n", err)
+		exitCode = 1
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Requests still running use libvips and the cache client too
+		log.Println("Requests still in flight, exiting without cleanup")
+		os.Exit(exitCode)
+	}
+
+	// Images whose clients already left keep being optimized to get cached
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	err = imageService.Wait(drainCtx)
+	cancel()
+	if err != nil {
+		// The optimizations still running use libvips and the cache client,
+		// closing them now could crash the process or corrupt cache writes
+		log.Printf("Error waiting for in-flight optimizations, exiting without cleanup: %v\n", err)
+		os.Exit(1)
+	}
+	if err := imageRepository.Close(); err != nil {
+		log.Printf("Error closing cache connection: %v\n", err)
+	}
+	ic.CloseVips()
+	log.Println("Image Optimizer stopped")
+	os.Exit(exitCode)
 }
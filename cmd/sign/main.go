@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	_ "github.com/joho/godotenv/autoload"
+	"github.com/patrickn2/go-image-optimizer/pkg/urlsigner"
+)
+
+// Signs image optimizer URLs with the first key of URL_SIGNING_KEYS
+//
+// Usage: sign [-keys keyId:secret] "http://localhost:8080/image?url=https://example.com/a.jpg&w=300"
+func main() {
+	keysFlag := flag.String("keys", os.Getenv("URL_SIGNING_KEYS"), "signing keys as keyId:secret pairs, the first one is used to sign")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: sign [-keys keyId:secret] <url>...")
+		os.Exit(2)
+	}
+
+	keys, err := urlsigner.ParseKeys(*keysFlag)
+	if err != nil {
+		log.Fatalf("Invalid signing keys: %v\n", err)
+	}
+	if len(keys) == 0 {
+		log.Fatalf("No signing keys, set URL_SIGNING_KEYS or use -keys\n")
+	}
+	signer := urlsigner.New(keys...)
+	for _, u := range flag.Args() {
+		signed, err := signer.SignURL(u)
+		if err != nil {
+			log.Fatalf("Error signing url %s: %v\n", u, err)
+		}
+		fmt.Println(signed)
+	}
+}
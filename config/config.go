@@ -3,39 +3,84 @@ package config
 import (
 	"bytes"
 	"context"
+	"fmt"
 	"log"
 	"net/http"
+	"net/netip"
 	"net/url"
 	"os"
 	"regexp"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress"
+	"github.com/patrickn2/go-image-optimizer/pkg/safehttp"
+	"github.com/patrickn2/go-image-optimizer/pkg/urlsigner"
 	"github.com/sethvargo/go-envconfig"
 )
 
 type Envs struct {
-	ApiPort              string `env:"API_PORT, required"`
-	ImageApiPath         string `env:"IMAGE_API_PATH"`
-	BrokenImagePath      string `env:"BROKEN_IMAGE_PATH"`
-	DefaultQuality       int    `env:"DEFAULT_QUALITY"`
-	MIS                  string `env:"MAX_IMAGE_SIZE, required"`
-	MaxImageSize         int64
-	CacheType            string `env:"CACHE_TYPE, required"`
-	CachePath            string `env:"CACHE_PATH"`
-	CacheExpiration      uint   `env:"CACHE_EXPIRATION"`
-	RedisHost            string `env:"REDIS_HOST"`
-	RedisPort            int    `env:"REDIS_PORT"`
-	RedisPassword        string `env:"REDIS_PASSWORD"`
-	RedisDB              int    `env:"REDIS_DB"`
-	MemcacheHost         string `env:"MEMCACHE_HOST"`
-	MemcachePort         int    `env:"MEMCACHE_PORT"`
-	MemcacheUser         string `env:"MEMCACHE_USERNAME"`
-	MemcachePassword     string `env:"MEMCACHE_PASSWORD"`
-	AuthorizedHostnames  string `env:"AUTHORIZED_HOSTNAMES"`
-	ImageDownloadTimeout int    `env:"IMAGE_DOWNLOAD_TIMEOUT"`
-	BrokenImageData      []byte
+	ApiPort                string `env:"API_PORT, required"`
+	ImageApiPath           string `env:"IMAGE_API_PATH"`
+	MetricsPort            string `env:"METRICS_PORT, default=9090"`
+	ReadTimeout            int    `env:"READ_TIMEOUT, default=10"`
+	WriteTimeout           int    `env:"WRITE_TIMEOUT, default=30"`
+	IdleTimeout            int    `env:"IDLE_TIMEOUT, default=120"`
+	ShutdownTimeout        int    `env:"SHUTDOWN_TIMEOUT, default=30"`
+	DrainDelay             int    `env:"DRAIN_DELAY, default=5"`
+	BrokenImagePath        string `env:"BROKEN_IMAGE_PATH"`
+	DefaultQuality         int    `env:"DEFAULT_QUALITY"`
+	FP                     string `env:"FORMAT_PREFERENCE, default=avif,webp"`
+	FormatPreference       []string
+	SaveDataQuality        int    `env:"SAVE_DATA_QUALITY, default=50"`
+	MDPR                   string `env:"MAX_DPR, default=3"`
+	MaxDPR                 float64
+	MIS                    string `env:"MAX_IMAGE_SIZE, required"`
+	MaxImageSize           int64
+	MaxSourcePixels        int    `env:"MAX_SOURCE_PIXELS, default=50000000"`
+	MaxSourceFrames        int    `env:"MAX_SOURCE_FRAMES, default=500"`
+	MaxSourceSide          int    `env:"MAX_SOURCE_SIDE, default=16384"`
+	CacheType              string `env:"CACHE_TYPE, required"`
+	CachePath              string `env:"CACHE_PATH"`
+	CacheExpiration        uint   `env:"CACHE_EXPIRATION"`
+	CMB                    string `env:"CACHE_MAX_BYTES, default=256MB"`
+	OriginRevalidateAfter  int    `env:"ORIGIN_REVALIDATE_AFTER"`
+	OriginStaleRevalidate  int    `env:"ORIGIN_STALE_WHILE_REVALIDATE, default=3600"`
+	CacheMaxBytes          int64
+	RedisHost              string `env:"REDIS_HOST"`
+	RedisPort              int    `env:"REDIS_PORT"`
+	RedisPassword          string `env:"REDIS_PASSWORD"`
+	RedisDB                int    `env:"REDIS_DB"`
+	MemcacheHost           string `env:"MEMCACHE_HOST"`
+	MemcachePort           int    `env:"MEMCACHE_PORT"`
+	MemcacheUser           string `env:"MEMCACHE_USERNAME"`
+	MemcachePassword       string `env:"MEMCACHE_PASSWORD"`
+	AuthorizedHostnames    string `env:"AUTHORIZED_HOSTNAMES"`
+	ImageDownloadTimeout   int    `env:"IMAGE_DOWNLOAD_TIMEOUT"`
+	SAC                    string `env:"SSRF_ALLOW_CIDRS"`
+	SsrfAllowCIDRs         []netip.Prefix
+	SDC                    string `env:"SSRF_DENY_CIDRS"`
+	SsrfDenyCIDRs          []netip.Prefix
+	MaxRedirects           int    `env:"MAX_REDIRECTS, default=3"`
+	ProcessingConcurrency  int    `env:"PROCESSING_CONCURRENCY"`
+	ProcessingQueueSize    int    `env:"PROCESSING_QUEUE_SIZE, default=100"`
+	ProcessingQueueTimeout int    `env:"PROCESSING_QUEUE_TIMEOUT, default=5"`
+	VipsConcurrency        int    `env:"VIPS_CONCURRENCY, default=-1"`
+	VipsMaxCacheFiles      int    `env:"VIPS_MAX_CACHE_FILES, default=-1"`
+	VMCM                   string `env:"VIPS_MAX_CACHE_MEM, default=-1"`
+	VipsMaxCacheMem        int
+	VipsMaxCacheSize       int    `env:"VIPS_MAX_CACHE_SIZE, default=-1"`
+	SvgMinify              bool   `env:"SVG_MINIFY, default=false"`
+	JxlEffort              int    `env:"JXL_EFFORT, default=7"`
+	JD                     string `env:"JXL_DISTANCE, default=0"`
+	JxlDistance            float64
+	AdminToken             string `env:"ADMIN_TOKEN"`
+	USK                    string `env:"URL_SIGNING_KEYS"`
+	UrlSigningKeys         []urlsigner.Key
+	BrokenImageData        []byte
 }
 
 var envList Envs
@@ -53,9 +98,59 @@ func Init() *Envs {
 		log.Fatalf("Invalid MAX_IMAGE_SIZE env value: %v\n", err)
 	}
 	envList.MaxImageSize = MaxImageSize
+	if envList.ReadTimeout < 0 || envList.WriteTimeout < 0 || envList.IdleTimeout < 0 {
+		log.Fatalf("READ_TIMEOUT, WRITE_TIMEOUT and IDLE_TIMEOUT env values must not be negative\n")
+	}
+	if envList.ShutdownTimeout < 1 {
+		envList.ShutdownTimeout = 1
+	}
+	if envList.DrainDelay < 0 {
+		log.Fatalf("DRAIN_DELAY env value must not be negative\n")
+	}
+	if envList.ProcessingConcurrency < 1 {
+		envList.ProcessingConcurrency = runtime.NumCPU()
+	}
+	if envList.ProcessingQueueSize < 0 {
+		log.Fatalf("PROCESSING_QUEUE_SIZE env value is invalid\n")
+	}
+	if envList.ProcessingQueueTimeout < 1 {
+		envList.ProcessingQueueTimeout = 1
+	}
+	vipsMaxCacheMem, err := convertToBytes(envList.VMCM)
+	if err != nil {
+		log.Fatalf("Invalid VIPS_MAX_CACHE_MEM env value: %v\n", err)
+	}
+	envList.VipsMaxCacheMem = int(vipsMaxCacheMem)
+	if envList.JxlEffort < 1 || envList.JxlEffort > 9 {
+		log.Fatalf("JXL_EFFORT env value must be between 1 and 9\n")
+	}
+	envList.JxlDistance, err = strconv.ParseFloat(envList.JD, 64)
+	if err != nil || envList.JxlDistance < 0 || envList.JxlDistance > 25 {
+		log.Fatalf("JXL_DISTANCE env value must be between 0 and 25\n")
+	}
 	if envList.DefaultQuality < 1 || envList.DefaultQuality > 100 {
 		log.Fatalf("DEFAULT_QUALITY env value is invalid\n")
 	}
+	envList.FormatPreference, err = parseFormats(envList.FP)
+	if err != nil {
+		log.Fatalf("Invalid FORMAT_PREFERENCE env value: %v\n", err)
+	}
+	if envList.SaveDataQuality < 1 || envList.SaveDataQuality > 100 {
+		log.Fatalf("SAVE_DATA_QUALITY env value is invalid\n")
+	}
+	envList.MaxDPR, err = strconv.ParseFloat(envList.MDPR, 64)
+	if err != nil || envList.MaxDPR < 1 {
+		log.Fatalf("MAX_DPR env value must be a number not lower than 1\n")
+	}
+
+	envList.CacheMaxBytes, err = convertToBytes(envList.CMB)
+	if err != nil || envList.CacheMaxBytes < 0 {
+		log.Fatalf("Invalid CACHE_MAX_BYTES env value: %v\n", err)
+	}
+
+	if envList.OriginRevalidateAfter < 0 || envList.OriginStaleRevalidate < 0 {
+		log.Fatalf("ORIGIN_REVALIDATE_AFTER and ORIGIN_STALE_WHILE_REVALIDATE env values must not be negative\n")
+	}
 
 	if envList.CacheType != "file" && envList.CacheType != "redis" && envList.CacheType != "in-memory" && envList.CacheType != "memcache" {
 		log.Fatalf("CACHE_TYPE env value is invalid\n")
@@ -71,12 +166,28 @@ func Init() *Envs {
 			log.Fatalf("AUTHORIZED_HOSTNAME env value regex is invalid\n")
 		}
 	}
+	envList.SsrfAllowCIDRs, err = safehttp.ParseCIDRs(envList.SAC)
+	if err != nil {
+		log.Fatalf("Invalid SSRF_ALLOW_CIDRS env value: %v\n", err)
+	}
+	envList.SsrfDenyCIDRs, err = safehttp.ParseCIDRs(envList.SDC)
+	if err != nil {
+		log.Fatalf("Invalid SSRF_DENY_CIDRS env value: %v\n", err)
+	}
+	if envList.MaxRedirects < 0 {
+		log.Fatalf("MAX_REDIRECTS env value is invalid\n")
+	}
+	envList.UrlSigningKeys, err = urlsigner.ParseKeys(envList.USK)
+	if err != nil {
+		log.Fatalf("Invalid URL_SIGNING_KEYS env value: %v\n", err)
+	}
 
 	// Initialization Messages
 	if envList.ImageApiPath == "" {
 		envList.ImageApiPath = "/image"
 	}
 	log.Printf("Max image size: %s\n", envList.MIS)
+	log.Printf("Max source pixels: %d, frames: %d, side: %d\n", envList.MaxSourcePixels, envList.MaxSourceFrames, envList.MaxSourceSide)
 	if envList.BrokenImagePath != "" {
 		log.Printf("Default image: %s\n", envList.BrokenImagePath)
 		// Load broken image
@@ -109,12 +220,18 @@ func Init() *Envs {
 	}
 
 	log.Printf("Image Download Timeout: %d Seconds\n", envList.ImageDownloadTimeout)
+	log.Printf("Max Redirects: %d\n", envList.MaxRedirects)
+	log.Printf("Processing Concurrency: %d, Queue Size: %d, Queue Timeout: %d Seconds\n", envList.ProcessingConcurrency, envList.ProcessingQueueSize, envList.ProcessingQueueTimeout)
+	log.Printf("Format Preference: %s\n", strings.Join(envList.FormatPreference, ", "))
 	log.Printf("Cache Type: %s\n", envList.CacheType)
+	if envList.OriginRevalidateAfter > 0 {
+		log.Printf("Origin Revalidation After: %d Seconds, Stale While Revalidate: %d Seconds\n", envList.OriginRevalidateAfter, envList.OriginStaleRevalidate)
+	}
 	if envList.CacheType == "file" {
-		log.Printf("Your Images will be saved locally in the Hard Drive path: %s\n", envList.CachePath)
+		log.Printf("Your Images will be saved locally in the Hard Drive path: %s, max size: %s\n", envList.CachePath, envList.CMB)
 	}
 	if envList.CacheType == "in-memory" {
-		log.Printf("Your Images will be saved in the RAM Memory\n")
+		log.Printf("Your Images will be saved in the RAM Memory, max size: %s\n", envList.CMB)
 	}
 	if envList.CacheType == "redis" {
 		log.Printf("Your Images will be saved in the Redis cache\n")
@@ -123,6 +240,15 @@ func Init() *Envs {
 		log.Printf("Your Images will be saved in the Memcache cache\n")
 	}
 	log.Printf("API Image Path: %s\n", envList.ImageApiPath)
+	if envList.MetricsPort != "" {
+		log.Printf("Metrics Port: %s\n", envList.MetricsPort)
+	}
+	if envList.AdminToken != "" {
+		log.Printf("Admin API enabled\n")
+	}
+	if len(envList.UrlSigningKeys) > 0 {
+		log.Printf("URL signing enabled with %d key(s), signing with key id: %s\n", len(envList.UrlSigningKeys), envList.UrlSigningKeys[0].ID)
+	}
 
 	return &envList
 }
@@ -150,3 +276,20 @@ func convertToBytes(size string) (int64, error) {
 		return int64(s), nil
 	}
 }
+
+// parseFormats parses a comma separated list of output format names, in order of preference
+func parseFormats(list string) ([]string, error) {
+	var formats []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		format := "image/" + name
+		if !slices.Contains(imagecompress.NegotiatedFormats, format) {
+			return nil, fmt.Errorf("unsupported format %s", name)
+		}
+		formats = append(formats, format)
+	}
+	return formats, nil
+}
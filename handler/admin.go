@@ -0,0 +1,58 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/patrickn2/go-image-optimizer/service"
+)
+
+type purgeRequest struct {
+	Url    string `json:"url"`
+	Prefix string `json:"prefix"`
+	Glob   string `json:"glob"`
+}
+
+// Purge deletes the cached variants of a source URL, a URL prefix or a URL glob.
+// It requires the ADMIN_TOKEN as a bearer token and is disabled without it.
+func (h *Handler) Purge(w http.ResponseWriter, r *http.Request) {
+	if h.envs.AdminToken == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.envs.AdminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body purgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	response, err := h.is.Purge(&service.PurgeRequest{
+		Ctx:    r.Context(),
+		Url:    body.Url,
+		Prefix: body.Prefix,
+		Glob:   body.Glob,
+	})
+	if err != nil {
+		switch err {
+		case service.ErrInvalidPurge:
+			w.WriteHeader(http.StatusBadRequest)
+		case service.ErrPurgeNotSupported:
+			w.WriteHeader(http.StatusNotImplemented)
+		default:
+			log.Printf("Error purging cache: %v\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
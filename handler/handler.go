@@ -1,57 +1,131 @@
 package handler
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/CAFxX/httpcompression"
 	"github.com/patrickn2/go-image-optimizer/config"
+	"github.com/patrickn2/go-image-optimizer/pkg/accept"
+	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress"
+	"github.com/patrickn2/go-image-optimizer/pkg/imageformat"
+	"github.com/patrickn2/go-image-optimizer/pkg/urlsigner"
 	"github.com/patrickn2/go-image-optimizer/service"
 )
 
 type Handler struct {
-	is   *service.ImageService
-	envs *config.Envs
+	is       *service.ImageService
+	envs     *config.Envs
+	signer   *urlsigner.Signer
+	compress func(http.Handler) http.Handler
+	draining atomic.Bool
 }
 
 func New(is *service.ImageService, e *config.Envs) *Handler {
-	return &Handler{
-		is:   is,
-		envs: e,
+	contentType := httpcompression.ContentTypes([]string{imageformat.SVG}, false)
+	compress, err := httpcompression.DefaultAdapter(contentType)
+	if err != nil {
+		log.Fatal(err)
+	}
+	h := &Handler{
+		is:       is,
+		envs:     e,
+		compress: compress,
+	}
+	if len(e.UrlSigningKeys) > 0 {
+		h.signer = urlsigner.New(e.UrlSigningKeys...)
 	}
+	return h
 }
 
 func (h *Handler) OptimizeImage(w http.ResponseWriter, r *http.Request) {
+	if h.signer != nil {
+		if err := h.signer.Verify(r.URL.Query()); err != nil {
+			log.Printf("%v\n", err)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	if h.signer == nil {
+		w.Header().Set("Accept-CH", acceptCH)
+	}
+
 	imageUrl := r.URL.Query().Get("url")
 	width := r.URL.Query().Get("w")
 	height := r.URL.Query().Get("h")
+	dpr := r.URL.Query().Get("dpr")
 	quality := r.URL.Query().Get("q")
-	ifModifiedSince := r.Header.Get("If-Modified-Since")
-	cacheControl := r.Header.Get("Cache-Control")
-	accept := r.Header.Get("Accept")
-
-	formats := strings.Split(accept, ",")
+	fm := r.URL.Query().Get("fm")
+	rasterize := r.URL.Query().Get("rasterize")
+	fit := r.URL.Query().Get("fit")
+	gravity := r.URL.Query().Get("gravity")
+	focalX := r.URL.Query().Get("fp-x")
+	focalY := r.URL.Query().Get("fp-y")
+	formats := accept.Parse(r.Header.Get("Accept"))
 
 	intQuality, err := strconv.Atoi(quality)
 	if err != nil || intQuality < 0 || intQuality > 100 {
 		intQuality = h.envs.DefaultQuality
 	}
 
-	intWidth, err := strconv.Atoi(width)
+	size, err := h.clientSizing(r, width, height, dpr, intQuality)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	intWidth, intHeight, intQuality := size.Width, size.Height, size.Quality
+
+	format, err := h.parseFormat(fm)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	if intWidth < 1 {
+	boolRasterize := false
+	if rasterize != "" {
+		boolRasterize, err = strconv.ParseBool(rasterize)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if fit == "" {
+		fit = imagecompress.FitCover
+	}
+	if !slices.Contains(imagecompress.Fits, fit) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if gravity == "" {
+		gravity = imagecompress.GravityCenter
+		// A focal point without gravity implies the focal point gravity
+		if focalX != "" || focalY != "" {
+			gravity = imagecompress.GravityFocalPoint
+		}
+	}
+	if !slices.Contains(imagecompress.Gravities, gravity) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	intHeight, err := strconv.Atoi(height)
-	if err != nil || intHeight < 1 {
-		intHeight = 0
+	var floatFocalX, floatFocalY float64
+	if gravity == imagecompress.GravityFocalPoint {
+		floatFocalX, err = parseFocalPoint(focalX)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		floatFocalY, err = parseFocalPoint(focalY)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
 	request := &service.OptimizeRequest{
@@ -60,12 +134,20 @@ func (h *Handler) OptimizeImage(w http.ResponseWriter, r *http.Request) {
 		Width:                intWidth,
 		Height:               intHeight,
 		Quality:              intQuality,
-		IfModifiedSince:      ifModifiedSince,
-		CacheControl:         cacheControl,
+		Fit:                  fit,
+		Gravity:              gravity,
+		FocalX:               floatFocalX,
+		FocalY:               floatFocalY,
 		MaxImageSize:         h.envs.MaxImageSize,
 		AuthorizedDomains:    h.envs.AuthorizedHostnames,
 		ImageDownloadTimeout: h.envs.ImageDownloadTimeout,
+		Format:               format,
 		AcceptedFormats:      formats,
+		FormatPreference:     h.envs.FormatPreference,
+		SvgMinify:            h.envs.SvgMinify,
+		Rasterize:            boolRasterize,
+		RevalidateAfter:      time.Duration(h.envs.OriginRevalidateAfter) * time.Second,
+		StaleWhileRevalidate: time.Duration(h.envs.OriginStaleRevalidate) * time.Second,
 	}
 
 	optimizedResponse, err := h.is.Optimize(request)
@@ -75,21 +157,44 @@ func (h *Handler) OptimizeImage(w http.ResponseWriter, r *http.Request) {
 			log.Printf("%v\n", err)
 			w.WriteHeader(http.StatusUnauthorized)
 			return
+		case service.ErrForbiddenAddress:
+			log.Printf("%v: %s\n", err, imageUrl)
+			w.WriteHeader(http.StatusForbidden)
+			return
 		case service.ErrInvalidImageUrl:
 			brokenImageRequest := &service.BrokenImageRequest{
-				Ctx:             r.Context(),
-				BrokenImageData: h.envs.BrokenImageData,
-				Quality:         intQuality,
-				Width:           intWidth,
-				Height:          intHeight,
-				AcceptedFormats: formats,
+				Ctx:              r.Context(),
+				BrokenImageData:  h.envs.BrokenImageData,
+				Quality:          intQuality,
+				Width:            intWidth,
+				Height:           intHeight,
+				Fit:              fit,
+				Gravity:          gravity,
+				FocalX:           floatFocalX,
+				FocalY:           floatFocalY,
+				Format:           format,
+				AcceptedFormats:  formats,
+				FormatPreference: h.envs.FormatPreference,
+				SvgMinify:        h.envs.SvgMinify,
+				Rasterize:        boolRasterize,
 			}
 			optimizedResponse, err = h.is.BrokenImage(brokenImageRequest)
+			if err == service.ErrServerBusy {
+				h.serverBusy(w, err)
+				return
+			}
 			if err != nil {
 				log.Printf("Error optimizing image: %v\n", err)
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+		case service.ErrServerBusy:
+			h.serverBusy(w, err)
+			return
+		case service.ErrImageTooLarge:
+			log.Printf("%v: %s\n", err, imageUrl)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
 		default:
 			log.Printf("Error optimizing image: %v\n", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -110,20 +215,67 @@ func (h *Handler) OptimizeImage(w http.ResponseWriter, r *http.Request) {
 	if optimizedResponse.Modified != nil {
 		lastModified = *optimizedResponse.Modified
 	}
-	w.Header().Set("Date", lastModified.Format(http.TimeFormat))
+	w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
 	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	w.Header().Set("ETag", optimizedResponse.ETag)
 	w.Header().Set("Age", strconv.Itoa(ageSeconds))
-	w.Header().Set("Content-Type", fmt.Sprintf("%s", optimizedResponse.ImageFormat))
 	w.Header().Set("Cache-Control", "public, max-age=2592000")
 	w.Header().Set("Content-Security-Policy", "script-src 'none'; frame-src 'none'; sandbox;")
-	w.Header().Set("Content-Length", strconv.Itoa(len(optimizedResponse.ImageData)))
 	w.Header().Set("X-Cache", cacheMsg)
-	w.Header().Set("Vary", "Accept")
+	vary := size.Vary
+	// Forced formats don't depend on Accept, CDNs keep a single copy of them
+	if format == "" {
+		vary = append([]string{"Accept"}, vary...)
+	}
+	w.Header().Set("Vary", strings.Join(vary, ", "))
+
+	w.Header().Set("Content-Type", optimizedResponse.ImageFormat)
 
 	defer log.Println("---------------------------------------------------")
-	if optimizedResponse.ImageData == nil && optimizedResponse.Cache {
-		w.WriteHeader(http.StatusNotModified)
+	// ServeContent evaluates the preconditions against the ETag and Last-Modified
+	// as RFC 9110 defines, and serves single and multiple byte ranges with If-Range
+	serveContent := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "", lastModified, bytes.NewReader(optimizedResponse.ImageData))
+	})
+	// Only SVG is worth compressing, the adapter drops the Range header of every
+	// request accepting an encoding so the other formats skip it to keep ranges
+	if optimizedResponse.ImageFormat == imageformat.SVG {
+		h.compress(serveContent).ServeHTTP(w, r)
 		return
 	}
-	w.Write(optimizedResponse.ImageData)
+	serveContent(w, r)
+}
+
+func (h *Handler) serverBusy(w http.ResponseWriter, err error) {
+	log.Printf("%v\n", err)
+	w.Header().Set("Retry-After", strconv.Itoa(h.envs.ProcessingQueueTimeout))
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+// parseFormat returns the output format forced by the fm param, empty when
+// it is auto and the format is negotiated with the Accept header
+func (h *Handler) parseFormat(fm string) (string, error) {
+	if fm == "" || fm == "auto" {
+		return "", nil
+	}
+	format := "image/" + fm
+	if !h.is.SupportsFormat(format) {
+		return "", fmt.Errorf("unsupported output format %s", fm)
+	}
+	return format, nil
+}
+
+// parseFocalPoint parses a relative focal point coordinate, empty means the center
+func parseFocalPoint(v string) (float64, error) {
+	if v == "" {
+		return 0.5, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || f > 1 {
+		return 0, fmt.Errorf("focal point %s out of range", v)
+	}
+	return f, nil
 }
@@ -0,0 +1,358 @@
+package handler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/patrickn2/go-image-optimizer/config"
+	"github.com/patrickn2/go-image-optimizer/pkg/urlsigner"
+	"github.com/patrickn2/go-image-optimizer/service/servicetest"
+)
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 32; x++ {
+		for y := 0; y < 32; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 8), G: uint8(y * 8), B: uint8(x ^ y), A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newHandler serves the files from a test origin and returns the handler and the origin URL
+func newHandler(t *testing.T, files map[string][]byte) (*Handler, string) {
+	t.Helper()
+	is, originUrl := servicetest.NewService(t, files)
+	h := New(is, &config.Envs{
+		DefaultQuality:       80,
+		SaveDataQuality:      50,
+		MaxDPR:               3,
+		MaxImageSize:         10 << 20,
+		MaxSourceSide:        16384,
+		MaxSourcePixels:      50000000,
+		ImageDownloadTimeout: 5,
+	})
+	return h, originUrl
+}
+
+// newTestHandler returns the handler and the target of a PNG image
+func newTestHandler(t *testing.T) (*Handler, string) {
+	t.Helper()
+	h, originUrl := newHandler(t, map[string][]byte{"/a.png": testPNG(t)})
+	return h, "/image?w=32&url=" + url.QueryEscape(originUrl+"/a.png")
+}
+
+func serve(h *Handler, target string, headers map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.OptimizeImage(w, r)
+	return w
+}
+
+// firstResponse primes the cache and returns the validators and size of the image
+func firstResponse(t *testing.T, h *Handler, target string) (etag string, lastModified time.Time, size int) {
+	t.Helper()
+	w := serve(h, target, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d, want 200", w.Code)
+	}
+	etag = w.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("ETag = %q, want a strong ETag", etag)
+	}
+	lastModified, err := http.ParseTime(w.Header().Get("Last-Modified"))
+	if err != nil {
+		t.Fatalf("Last-Modified: %v", err)
+	}
+	if w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Accept-Ranges = %q, want bytes", w.Header().Get("Accept-Ranges"))
+	}
+	return etag, lastModified, w.Body.Len()
+}
+
+func TestConditionalRequests(t *testing.T) {
+	h, target := newTestHandler(t)
+	etag, lastModified, _ := firstResponse(t, h, target)
+	before := lastModified.Add(-time.Hour).Format(http.TimeFormat)
+	equal := lastModified.Format(http.TimeFormat)
+	after := lastModified.Add(time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{"no preconditions", nil, http.StatusOK},
+		{"If-None-Match strong match", map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{"If-None-Match weak match", map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{"If-None-Match star", map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{"If-None-Match list with match", map[string]string{"If-None-Match": `"other", ` + etag + `, W/"another"`}, http.StatusNotModified},
+		{"If-None-Match list without match", map[string]string{"If-None-Match": `"other", W/"another"`}, http.StatusOK},
+		{"If-None-Match no match", map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{"If-None-Match no match wins over If-Modified-Since", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": after}, http.StatusOK},
+		{"If-None-Match match wins over If-Modified-Since", map[string]string{"If-None-Match": etag, "If-Modified-Since": before}, http.StatusNotModified},
+		{"If-Modified-Since before Last-Modified", map[string]string{"If-Modified-Since": before}, http.StatusOK},
+		{"If-Modified-Since equal to Last-Modified", map[string]string{"If-Modified-Since": equal}, http.StatusNotModified},
+		{"If-Modified-Since after Last-Modified", map[string]string{"If-Modified-Since": after}, http.StatusNotModified},
+		{"If-Modified-Since invalid", map[string]string{"If-Modified-Since": "yesterday"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, target, tt.headers)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Header().Get("ETag") != etag {
+				t.Errorf("ETag = %q, want %q", w.Header().Get("ETag"), etag)
+			}
+			if tt.status == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 with a %d bytes body", w.Body.Len())
+			}
+		})
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	h, target := newTestHandler(t)
+	etag, lastModified, size := firstResponse(t, h, target)
+	total := strconv.Itoa(size)
+
+	tests := []struct {
+		name         string
+		headers      map[string]string
+		status       int
+		contentRange string
+		multipart    bool
+	}{
+		{"single range", map[string]string{"Range": "bytes=0-9"}, http.StatusPartialContent, "bytes 0-9/" + total, false},
+		{"single range accepting gzip", map[string]string{"Range": "bytes=0-9", "Accept-Encoding": "gzip"}, http.StatusPartialContent, "bytes 0-9/" + total, false},
+		{"single range accepting any encoding", map[string]string{"Range": "bytes=0-9", "Accept-Encoding": "gzip, deflate, br"}, http.StatusPartialContent, "bytes 0-9/" + total, false},
+		{"suffix range", map[string]string{"Range": "bytes=-5"}, http.StatusPartialContent, "bytes " + strconv.Itoa(size-5) + "-" + strconv.Itoa(size-1) + "/" + total, false},
+		{"multiple ranges", map[string]string{"Range": "bytes=0-1,4-5"}, http.StatusPartialContent, "", true},
+		{"If-Range ETag match", map[string]string{"Range": "bytes=0-9", "If-Range": etag}, http.StatusPartialContent, "bytes 0-9/" + total, false},
+		{"If-Range ETag match multiple ranges", map[string]string{"Range": "bytes=0-1,4-5", "If-Range": etag}, http.StatusPartialContent, "", true},
+		{"If-Range ETag mismatch", map[string]string{"Range": "bytes=0-9", "If-Range": `"other"`}, http.StatusOK, "", false},
+		{"If-Range ETag mismatch multiple ranges", map[string]string{"Range": "bytes=0-1,4-5", "If-Range": `"other"`}, http.StatusOK, "", false},
+		{"If-Range weak ETag", map[string]string{"Range": "bytes=0-9", "If-Range": "W/" + etag}, http.StatusOK, "", false},
+		{"If-Range date match", map[string]string{"Range": "bytes=0-9", "If-Range": lastModified.Format(http.TimeFormat)}, http.StatusPartialContent, "bytes 0-9/" + total, false},
+		{"If-Range date match multiple ranges", map[string]string{"Range": "bytes=0-1,4-5", "If-Range": lastModified.Format(http.TimeFormat)}, http.StatusPartialContent, "", true},
+		{"If-Range date mismatch", map[string]string{"Range": "bytes=0-9", "If-Range": lastModified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK, "", false},
+		{"unsatisfiable range", map[string]string{"Range": "bytes=" + total + "-"}, http.StatusRequestedRangeNotSatisfiable, "bytes */" + total, false},
+		{"If-None-Match match with range", map[string]string{"Range": "bytes=0-9", "If-None-Match": etag}, http.StatusNotModified, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(h, target, tt.headers)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.contentRange != "" && w.Header().Get("Content-Range") != tt.contentRange {
+				t.Errorf("Content-Range = %q, want %q", w.Header().Get("Content-Range"), tt.contentRange)
+			}
+			if tt.multipart && !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") {
+				t.Errorf("Content-Type = %q, want multipart/byteranges", w.Header().Get("Content-Type"))
+			}
+			if tt.status == http.StatusOK && w.Body.Len() != size {
+				t.Errorf("body = %d bytes, want the full %d bytes", w.Body.Len(), size)
+			}
+			if tt.status == http.StatusPartialContent && !tt.multipart && w.Body.Len() >= size {
+				t.Errorf("body = %d bytes, want a part of %d bytes", w.Body.Len(), size)
+			}
+		})
+	}
+}
+
+func TestClientSizing(t *testing.T) {
+	envs := &config.Envs{
+		DefaultQuality:  80,
+		SaveDataQuality: 50,
+		MaxDPR:          3,
+		MaxSourceSide:   4000,
+		MaxSourcePixels: 4000 * 3000,
+	}
+	unsigned := &Handler{envs: envs}
+	signed := &Handler{envs: envs, signer: urlsigner.New(urlsigner.Key{ID: "k1", Secret: []byte("secret")})}
+	allHints := []string{"Save-Data", "Sec-CH-Width", "Sec-CH-Viewport-Width", "Sec-CH-DPR"}
+
+	tests := []struct {
+		name                  string
+		h                     *Handler
+		width, height, dpr    string
+		headers               map[string]string
+		wantWidth, wantHeight int
+		wantQuality           int
+		wantVary              []string
+		wantErr               error
+	}{
+		{"w param", unsigned, "100", "", "", nil, 100, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"w and h params", unsigned, "100", "50", "2", nil, 200, 100, 80, []string{"Save-Data"}, nil},
+		{"dpr param", unsigned, "100", "", "1.5", nil, 150, 0, 80, []string{"Save-Data"}, nil},
+		{"dpr hint", unsigned, "100", "", "", map[string]string{"Sec-CH-DPR": "2"}, 200, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"dpr param wins over the hint", unsigned, "100", "", "1.5", map[string]string{"Sec-CH-DPR": "3"}, 150, 0, 80, []string{"Save-Data"}, nil},
+		{"MAX_DPR caps the dpr param", unsigned, "100", "", "5", nil, 300, 0, 80, []string{"Save-Data"}, nil},
+		{"MAX_DPR caps the dpr hint", unsigned, "100", "", "", map[string]string{"Sec-CH-DPR": "4"}, 300, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"Sec-CH-Width in device pixels", unsigned, "", "", "", map[string]string{"Sec-CH-Width": "600", "Sec-CH-DPR": "2"}, 600, 0, 80, allHints, nil},
+		{"MAX_DPR caps Sec-CH-Width", unsigned, "", "", "", map[string]string{"Sec-CH-Width": "800", "Sec-CH-DPR": "4"}, 600, 0, 80, allHints, nil},
+		{"Sec-CH-Viewport-Width", unsigned, "", "", "", map[string]string{"Sec-CH-Viewport-Width": "400", "Sec-CH-DPR": "2"}, 800, 0, 80, allHints, nil},
+		{"Sec-CH-Width wins over Sec-CH-Viewport-Width", unsigned, "", "", "", map[string]string{"Sec-CH-Width": "300", "Sec-CH-Viewport-Width": "400"}, 300, 0, 80, allHints, nil},
+		{"w param wins over the width hints", unsigned, "100", "", "", map[string]string{"Sec-CH-Width": "300"}, 100, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"NaN dpr hint ignored", unsigned, "100", "", "", map[string]string{"Sec-CH-DPR": "NaN"}, 100, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"infinite dpr hint ignored", unsigned, "100", "", "", map[string]string{"Sec-CH-DPR": "+Inf"}, 100, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"negative dpr hint ignored", unsigned, "100", "", "", map[string]string{"Sec-CH-DPR": "-2"}, 100, 0, 80, []string{"Save-Data", "Sec-CH-DPR"}, nil},
+		{"invalid width hints", unsigned, "", "", "", map[string]string{"Sec-CH-Width": "0", "Sec-CH-Viewport-Width": "wide"}, 0, 0, 0, nil, errInvalidWidth},
+		{"no width", unsigned, "", "", "", nil, 0, 0, 0, nil, errInvalidWidth},
+		{"invalid w param", unsigned, "0", "", "", nil, 0, 0, 0, nil, errInvalidWidth},
+		{"NaN dpr param", unsigned, "100", "", "NaN", nil, 0, 0, 0, nil, errInvalidDPR},
+		{"zero dpr param", unsigned, "100", "", "0", nil, 0, 0, 0, nil, errInvalidDPR},
+		{"side above the source limits", unsigned, "2000", "", "3", nil, 0, 0, 0, nil, errTooLarge},
+		{"pixels above the source limits", unsigned, "4000", "4000", "1", nil, 0, 0, 0, nil, errTooLarge},
+		{"Save-Data", unsigned, "100", "", "1", map[string]string{"Save-Data": "on"}, 100, 0, 50, []string{"Save-Data"}, nil},
+		{"signed ignores the dpr hint", signed, "100", "", "", map[string]string{"Sec-CH-DPR": "2"}, 100, 0, 80, []string{"Save-Data"}, nil},
+		{"signed ignores the width hints", signed, "", "", "", map[string]string{"Sec-CH-Width": "600", "Sec-CH-Viewport-Width": "400"}, 0, 0, 0, nil, errInvalidWidth},
+		{"signed dpr param", signed, "100", "", "2", map[string]string{"Sec-CH-DPR": "3"}, 200, 0, 80, []string{"Save-Data"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/image", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			s, err := tt.h.clientSizing(r, tt.width, tt.height, tt.dpr, 80)
+			if err != tt.wantErr {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if s.Width != tt.wantWidth || s.Height != tt.wantHeight || s.Quality != tt.wantQuality {
+				t.Errorf("size = %dx%d q%d, want %dx%d q%d", s.Width, s.Height, s.Quality, tt.wantWidth, tt.wantHeight, tt.wantQuality)
+			}
+			if !slices.Equal(s.Vary, tt.wantVary) {
+				t.Errorf("Vary = %v, want %v", s.Vary, tt.wantVary)
+			}
+		})
+	}
+}
+
+func TestSvgIsCompressed(t *testing.T) {
+	svg := []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10">` + strings.Repeat(`<rect width="1" height="1"/>`, 50) + `</svg>`)
+	h, originUrl := newHandler(t, map[string][]byte{"/a.svg": svg})
+	target := "/image?w=10&url=" + url.QueryEscape(originUrl+"/a.svg")
+
+	w := serve(h, target, map[string]string{"Accept": "image/svg+xml", "Accept-Encoding": "gzip"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "image/svg+xml" {
+		t.Fatalf("Content-Type = %q, want image/svg+xml", w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	if vary := strings.Join(w.Header().Values("Vary"), ", "); !strings.Contains(vary, "Accept-Encoding") {
+		t.Errorf("Vary = %q, want Accept-Encoding listed", vary)
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(body, []byte("<svg")) {
+		t.Errorf("body = %.40q, want the SVG", body)
+	}
+
+	raster := serve(h, "/image?w=32&url="+url.QueryEscape(originUrl+"/a.svg"), map[string]string{"Accept-Encoding": "gzip"})
+	if raster.Header().Get("Content-Type") == "image/svg+xml" || raster.Header().Get("Content-Encoding") != "" {
+		t.Errorf("rasterized image Content-Type = %q, Content-Encoding = %q, want an uncompressed raster image", raster.Header().Get("Content-Type"), raster.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestReadyzDraining(t *testing.T) {
+	h, _ := newTestHandler(t)
+	for _, tt := range []struct {
+		name   string
+		drain  bool
+		status int
+	}{
+		{"serving", false, http.StatusOK},
+		{"draining", true, http.StatusServiceUnavailable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.drain {
+				h.Drain()
+			}
+			w := httptest.NewRecorder()
+			h.Readyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestPurgeAuthentication(t *testing.T) {
+	h, target := newTestHandler(t)
+	if w := serve(h, target, nil); w.Code != http.StatusOK {
+		t.Fatalf("priming request status = %d, want 200", w.Code)
+	}
+	imageUrl, _ := url.Parse(target)
+	body := `{"url":"` + imageUrl.Query().Get("url") + `"}`
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		body          string
+		status        int
+	}{
+		{"disabled without admin token", "", "Bearer secret", body, http.StatusNotFound},
+		{"missing token", "secret", "", body, http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", body, http.StatusUnauthorized},
+		{"not a bearer token", "secret", "Basic secret", body, http.StatusUnauthorized},
+		{"invalid body", "secret", "Bearer secret", `{"url":`, http.StatusBadRequest},
+		{"invalid purge", "secret", "Bearer secret", `{}`, http.StatusBadRequest},
+		{"purged", "secret", "Bearer secret", body, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.envs.AdminToken = tt.adminToken
+			r := httptest.NewRequest(http.MethodPost, "/admin/purge", strings.NewReader(tt.body))
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.Purge(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("WWW-Authenticate = %q, want Bearer", w.Header().Get("WWW-Authenticate"))
+			}
+			if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), `"variants":1`) {
+				t.Errorf("body = %s, want one purged variant", w.Body.String())
+			}
+		})
+	}
+}
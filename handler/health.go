@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Healthz reports the process is alive
+func (h *Handler) Healthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+}
+
+// Drain makes the readiness check fail, the load balancers stop sending new
+// requests while the server still accepts them
+func (h *Handler) Drain() {
+	h.draining.Store(true)
+}
+
+// Readyz reports if the cache backend and libvips are working
+func (h *Handler) Readyz(w http.ResponseWriter, r *http.Request) {
+	if h.draining.Load() {
+		writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "draining"})
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	response := healthResponse{
+		Status: "ok",
+		Checks: map[string]string{},
+	}
+	status := http.StatusOK
+	for _, check := range h.is.Ready(ctx) {
+		if check.Err != nil {
+			log.Printf("Readiness check %s failed: %v\n", check.Name, check.Err)
+			response.Checks[check.Name] = check.Err.Error()
+			response.Status = "error"
+			status = http.StatusServiceUnavailable
+			continue
+		}
+		response.Checks[check.Name] = "ok"
+	}
+	writeHealth(w, status, response)
+}
+
+func writeHealth(w http.ResponseWriter, status int, response healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptCH lists the client hints the image sizing uses, browsers only send
+// them after a response advertises them
+var acceptCH = strings.Join([]string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}, ", ")
+
+var (
+	errInvalidWidth = errors.New("invalid width")
+	errInvalidDPR   = errors.New("invalid dpr")
+	errTooLarge     = errors.New("output size too large")
+)
+
+type sizing struct {
+	Width   int
+	Height  int
+	Quality int
+	// Vary lists the request headers the sizing depends on
+	Vary []string
+}
+
+// clientSizing computes the output size in device pixels. The CSS width comes
+// from the w param or the Sec-CH-Width or Sec-CH-Viewport-Width hints and is
+// multiplied by the dpr param or the Sec-CH-DPR hint, capped to MAX_DPR.
+// Save-Data lowers the quality to SAVE_DATA_QUALITY.
+// The hints are not signed, with URL signing only the params size the image
+// so a signed URL can't be turned into any number of cached variants.
+func (h *Handler) clientSizing(r *http.Request, width, height, dpr string, quality int) (*sizing, error) {
+	s := &sizing{Quality: quality, Vary: []string{"Save-Data"}}
+	hints := h.signer == nil
+
+	// Invalid hints are ignored, only invalid params are rejected
+	clientDPR := 1.0
+	if v, err := parseDPR(r.Header.Get("Sec-CH-DPR")); err == nil && hints {
+		clientDPR = v
+	}
+	usesClientDPR := dpr == "" && hints
+	effectiveDPR := clientDPR
+	if dpr != "" {
+		v, err := parseDPR(dpr)
+		if err != nil {
+			return nil, err
+		}
+		effectiveDPR = v
+	}
+
+	var cssWidth float64
+	if width != "" {
+		v, err := strconv.Atoi(width)
+		if err != nil || v < 1 {
+			return nil, errInvalidWidth
+		}
+		cssWidth = float64(v)
+	} else if !hints {
+		return nil, errInvalidWidth
+	} else {
+		s.Vary = append(s.Vary, "Sec-CH-Width", "Sec-CH-Viewport-Width")
+		if v, err := strconv.Atoi(r.Header.Get("Sec-CH-Width")); err == nil && v > 0 {
+			// Sec-CH-Width is already in device pixels
+			cssWidth = float64(v) / clientDPR
+			usesClientDPR = true
+		} else if v, err := strconv.Atoi(r.Header.Get("Sec-CH-Viewport-Width")); err == nil && v > 0 {
+			cssWidth = float64(v)
+		} else {
+			return nil, errInvalidWidth
+		}
+	}
+	if usesClientDPR {
+		s.Vary = append(s.Vary, "Sec-CH-DPR")
+	}
+
+	effectiveDPR = min(effectiveDPR, h.envs.MaxDPR)
+	s.Width = max(1, int(math.Round(cssWidth*effectiveDPR)))
+	if v, err := strconv.Atoi(height); err == nil && v > 0 {
+		s.Height = max(1, int(math.Round(float64(v)*effectiveDPR)))
+	}
+	// The output canvas is allocated at the requested size, it has the same
+	// limits as the source images
+	if maxSide := h.envs.MaxSourceSide; maxSide > 0 && (s.Width > maxSide || s.Height > maxSide) {
+		return nil, errTooLarge
+	}
+	if maxPixels := h.envs.MaxSourcePixels; maxPixels > 0 && s.Width*s.Height > maxPixels {
+		return nil, errTooLarge
+	}
+	if strings.EqualFold(r.Header.Get("Save-Data"), "on") {
+		s.Quality = min(s.Quality, h.envs.SaveDataQuality)
+	}
+	return s, nil
+}
+
+func parseDPR(v string) (float64, error) {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(f) || f <= 0 || math.IsInf(f, 0) {
+		return 0, errInvalidDPR
+	}
+	return f, nil
+}
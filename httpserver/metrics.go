@@ -0,0 +1,52 @@
+package httpserver
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sr, r)
+		status := strconv.Itoa(sr.status)
+		metrics.RequestsTotal.WithLabelValues(status, w.Header().Get("Content-Type"), w.Header().Get("X-Cache")).Inc()
+		metrics.RequestDuration.WithLabelValues(status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// StartMetrics serves the prometheus metrics in its own port so they are not exposed with the images
+func StartMetrics(ctx context.Context, port string) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Println("Metrics listening on port", port)
+	if err := serve(ctx, server, 5*time.Second); err != nil {
+		log.Printf("Error serving metrics: %v\n", err)
+	}
+}
@@ -1,22 +1,67 @@
 package httpserver
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"time"
 
-	"github.com/CAFxX/httpcompression"
 	"github.com/patrickn2/go-image-optimizer/handler"
 )
 
-func Start(h *handler.Handler, port, imagePath string) {
-	contentType := httpcompression.ContentTypes([]string{"image/svg+xml"}, false)
-	compress, err := httpcompression.DefaultAdapter(contentType)
-	if err != nil {
-		log.Fatal(err)
+type Config struct {
+	Port            string
+	ImagePath       string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// Start serves the API until ctx is done, then stops accepting connections
+// and waits up to ShutdownTimeout for the in-flight requests to finish
+func Start(ctx context.Context, h *handler.Handler, c Config) error {
+	server := &http.Server{
+		Addr:         ":" + c.Port,
+		Handler:      routes(h, c.ImagePath),
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout:  c.IdleTimeout,
 	}
+	log.Println("Listening on port", c.Port)
+	return serve(ctx, server, c.ShutdownTimeout)
+}
+
+func routes(h *handler.Handler, imagePath string) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET "+imagePath, metricsMiddleware(http.HandlerFunc(h.OptimizeImage)))
+	mux.HandleFunc("GET /healthz", h.Healthz)
+	mux.HandleFunc("GET /readyz", h.Readyz)
+	mux.HandleFunc("POST /admin/purge", h.Purge)
+	return mux
+}
 
-	http.Handle("GET "+imagePath, compress(http.HandlerFunc(h.OptimizeImage)))
+func serve(ctx context.Context, server *http.Server, shutdownTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
 
-	log.Println("Listening on port", port)
-	http.ListenAndServe(":"+port, nil)
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down server %s, waiting up to %s for in-flight requests\n", server.Addr, shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
 }
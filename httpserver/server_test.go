@@ -0,0 +1,51 @@
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/patrickn2/go-image-optimizer/config"
+	"github.com/patrickn2/go-image-optimizer/handler"
+	"github.com/patrickn2/go-image-optimizer/service/servicetest"
+)
+
+// The handlers are tested in their package, only the routing is tested here
+func TestRoutes(t *testing.T) {
+	is, originUrl := servicetest.NewService(t, map[string][]byte{"/a.svg": []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"/>`)})
+	h := handler.New(is, &config.Envs{DefaultQuality: 80, MaxDPR: 3, MaxImageSize: 1 << 20, ImageDownloadTimeout: 5})
+	server := httptest.NewServer(routes(h, "/image"))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		method string
+		target string
+		status int
+	}{
+		{http.MethodGet, "/image?w=8&url=" + url.QueryEscape(originUrl+"/a.svg"), http.StatusOK},
+		{http.MethodPost, "/image", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/healthz", http.StatusOK},
+		{http.MethodGet, "/readyz", http.StatusOK},
+		// Disabled without an admin token
+		{http.MethodPost, "/admin/purge", http.StatusNotFound},
+		{http.MethodGet, "/admin/purge", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/other", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, server.URL+tt.target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := server.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+		})
+	}
+}
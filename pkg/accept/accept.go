@@ -0,0 +1,73 @@
+package accept
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MediaRange is an Accept header element with its weight
+type MediaRange struct {
+	Type string
+	Q    float64
+}
+
+type MediaRanges []MediaRange
+
+// Parse parses an Accept header as defined by RFC 9110 section 12.5.1, the
+// media type parameters other than q are ignored and invalid weights make the
+// range unacceptable
+func Parse(header string) MediaRanges {
+	var ranges MediaRanges
+	for _, element := range strings.Split(header, ",") {
+		mediaType, params, _ := strings.Cut(element, ";")
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" || !strings.Contains(mediaType, "/") {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			weight, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || weight < 0 || weight > 1 {
+				weight = 0
+			}
+			q = weight
+		}
+		ranges = append(ranges, MediaRange{Type: mediaType, Q: q})
+	}
+	return ranges
+}
+
+// Explicit reports if the media type is listed by itself with a weight above
+// 0. Clients send wildcards even for the formats they can't decode, so the
+// formats not every client supports must be listed explicitly.
+func (m MediaRanges) Explicit(mediaType string) bool {
+	return m.Weight(mediaType) > 0
+}
+
+// Weight returns the weight of the media type when it is listed by itself, 0 otherwise
+func (m MediaRanges) Weight(mediaType string) float64 {
+	mediaType = strings.ToLower(mediaType)
+	i := slices.IndexFunc(m, func(r MediaRange) bool { return r.Type == mediaType })
+	if i < 0 {
+		return 0
+	}
+	return m[i].Q
+}
+
+// Preferred returns the explicitly listed candidate with the highest weight,
+// ties are won by the first candidate. It is empty when none is acceptable.
+func (m MediaRanges) Preferred(candidates []string) string {
+	var preferred string
+	var best float64
+	for _, candidate := range candidates {
+		if q := m.Weight(candidate); q > best {
+			preferred, best = candidate, q
+		}
+	}
+	return preferred
+}
@@ -0,0 +1,82 @@
+package accept
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		header string
+		want   MediaRanges
+	}{
+		{"", nil},
+		{"image/webp", MediaRanges{{"image/webp", 1}}},
+		{"Image/AVIF ; Q=0.5", MediaRanges{{"image/avif", 0.5}}},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", MediaRanges{
+			{"image/avif", 1}, {"image/webp", 1}, {"image/apng", 1}, {"image/*", 1}, {"*/*", 0.8},
+		}},
+		{"image/webp;level=1;q=0.3", MediaRanges{{"image/webp", 0.3}}},
+		{"image/webp;q=0", MediaRanges{{"image/webp", 0}}},
+		{"image/webp;q=2", MediaRanges{{"image/webp", 0}}},
+		{"image/webp;q=-1", MediaRanges{{"image/webp", 0}}},
+		{"image/webp;q=abc", MediaRanges{{"image/webp", 0}}},
+		{"webp, , image/png", MediaRanges{{"image/png", 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := Parse(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExplicit(t *testing.T) {
+	tests := []struct {
+		header    string
+		mediaType string
+		want      bool
+	}{
+		{"image/avif,image/webp", "image/webp", true},
+		{"image/avif,image/webp", "IMAGE/WEBP", true},
+		{"image/*", "image/webp", false},
+		{"*/*", "image/avif", false},
+		{"image/webp;q=0", "image/webp", false},
+		{"image/webp;q=0.001", "image/webp", true},
+		{"", "image/webp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header+" "+tt.mediaType, func(t *testing.T) {
+			if got := Parse(tt.header).Explicit(tt.mediaType); got != tt.want {
+				t.Errorf("Explicit(%q) = %v, want %v", tt.mediaType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreferred(t *testing.T) {
+	preference := []string{"image/avif", "image/webp", "image/jxl"}
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"image/avif,image/webp", "image/avif"},
+		{"image/webp,image/avif", "image/avif"},
+		{"image/avif;q=0.1, image/webp;q=0.9", "image/webp"},
+		{"image/avif;q=0.9, image/webp;q=0.9, image/jxl;q=0.9", "image/avif"},
+		{"image/jxl, image/avif;q=0.5", "image/jxl"},
+		{"image/avif;q=0, image/webp;q=0.2", "image/webp"},
+		{"image/avif;q=0", ""},
+		{"image/*,*/*;q=0.8", ""},
+		{"image/png", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := Parse(tt.header).Preferred(preference); got != tt.want {
+				t.Errorf("Preferred() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
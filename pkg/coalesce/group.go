@@ -0,0 +1,115 @@
+package coalesce
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+type call[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// Group deduplicates concurrent calls with the same key, only the first one
+// runs and the others wait for its result
+type Group[T any] struct {
+	mu        sync.Mutex
+	calls     map[string]*call[T]
+	wg        sync.WaitGroup
+	executed  atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+type Stats struct {
+	// Executed is the number of calls that actually ran
+	Executed uint64
+	// Coalesced is the number of calls that waited for another call result
+	Coalesced uint64
+	// InFlight is the number of calls running right now
+	InFlight int
+}
+
+// Do runs fn once for all the concurrent callers with the same key. fn runs
+// with a context detached from the callers cancellation, so a caller giving
+// up doesn't kill the work the others are waiting for. A canceled caller
+// returns its context error right away while fn keeps running.
+// The returned bool reports if the result was shared from another caller.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(context.Context) (T, error)) (T, bool, error) {
+	c, shared := g.start(ctx, key, fn)
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		var zero T
+		return zero, shared, ctx.Err()
+	}
+}
+
+// Go runs fn like Do without waiting for its result, nothing runs when a
+// call with the same key is in progress. Wait waits for fn once Go returns.
+func (g *Group[T]) Go(ctx context.Context, key string, fn func(context.Context) (T, error)) {
+	g.start(ctx, key, fn)
+}
+
+// start joins the call in progress for the key or starts a new one
+func (g *Group[T]) start(ctx context.Context, key string, fn func(context.Context) (T, error)) (*call[T], bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[T])
+	}
+	if c, ok := g.calls[key]; ok {
+		g.coalesced.Add(1)
+		return c, true
+	}
+	c := &call[T]{done: make(chan struct{})}
+	g.calls[key] = c
+	g.executed.Add(1)
+	g.wg.Add(1)
+	go g.run(context.WithoutCancel(ctx), key, c, fn)
+	return c, false
+}
+
+func (g *Group[T]) run(ctx context.Context, key string, c *call[T], fn func(context.Context) (T, error)) {
+	defer func() {
+		// fn runs outside the caller goroutine, a panic would crash the whole process
+		if r := recover(); r != nil {
+			c.err = fmt.Errorf("coalesced call %s panicked: %v", key, r)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+		g.wg.Done()
+	}()
+	c.val, c.err = fn(ctx)
+}
+
+// Wait blocks until every running call finishes or ctx is done
+func (g *Group[T]) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (g *Group[T]) Stats() Stats {
+	g.mu.Lock()
+	inFlight := len(g.calls)
+	g.mu.Unlock()
+	return Stats{
+		Executed:  g.executed.Load(),
+		Coalesced: g.coalesced.Load(),
+		InFlight:  inFlight,
+	}
+}
@@ -0,0 +1,170 @@
+package coalesce
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDoCoalescesConcurrentCalls(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var calls int
+	fn := func(ctx context.Context) (int, error) {
+		calls++
+		close(started)
+		<-release
+		return 42, nil
+	}
+
+	const callers = 5
+	var wg sync.WaitGroup
+	results := make([]int, callers)
+	shared := make([]bool, callers)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		results[0], shared[0], _ = g.Do(context.Background(), "key", fn)
+	}()
+	<-started
+	for i := 1; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], shared[i], _ = g.Do(context.Background(), "key", fn)
+		}(i)
+	}
+	// Wait for the callers to join the running call before releasing it
+	for g.Stats().Coalesced != callers-1 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("fn ran %d times, want 1", calls)
+	}
+	for i, v := range results {
+		if v != 42 {
+			t.Errorf("caller %d got %d, want 42", i, v)
+		}
+		if shared[i] != (i > 0) {
+			t.Errorf("caller %d shared = %v, want %v", i, shared[i], i > 0)
+		}
+	}
+	stats := g.Stats()
+	if stats.Executed != 1 || stats.Coalesced != callers-1 || stats.InFlight != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestDo(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		fn      func(context.Context) (string, error)
+		want    string
+		wantErr error
+	}{
+		{"value", func(context.Context) (string, error) { return "ok", nil }, "ok", nil},
+		{"error", func(context.Context) (string, error) { return "", errFailed }, "", errFailed},
+		{"panic", func(context.Context) (string, error) { panic("boom") }, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g Group[string]
+			got, shared, err := g.Do(context.Background(), "key", tt.fn)
+			if shared {
+				t.Error("shared = true for a single caller")
+			}
+			if got != tt.want {
+				t.Errorf("Do() = %q, want %q", got, tt.want)
+			}
+			switch {
+			case tt.name == "panic":
+				if err == nil {
+					t.Error("Do() returned no error for a panicking fn")
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("Do() error = %v, want %v", err, tt.wantErr)
+			}
+			// The key is released once the call finishes
+			if got, _, _ := g.Do(context.Background(), "key", func(context.Context) (string, error) { return "again", nil }); got != "again" {
+				t.Errorf("second Do() = %q, want again", got)
+			}
+		})
+	}
+}
+
+func TestDoCanceledCallerDoesNotCancelFn(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	fnErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, _, err := g.Do(ctx, "key", func(ctx context.Context) (int, error) {
+		<-release
+		fnErr <- ctx.Err()
+		return 1, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Do() error = %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := g.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+	if err := <-fnErr; err != nil {
+		t.Errorf("fn context error = %v, want nil", err)
+	}
+}
+
+func TestWaitTimeout(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.Do(ctx, "key", func(context.Context) (int, error) {
+		<-release
+		return 1, nil
+	})
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+	if err := g.Wait(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Wait() = %v, want context.DeadlineExceeded", err)
+	}
+	if stats := g.Stats(); stats.InFlight != 1 {
+		t.Errorf("InFlight = %d, want 1", stats.InFlight)
+	}
+}
+
+func TestGo(t *testing.T) {
+	var g Group[int]
+	release := make(chan struct{})
+	var calls atomic.Int32
+	fn := func(context.Context) (int, error) {
+		calls.Add(1)
+		<-release
+		return 1, nil
+	}
+	g.Go(context.Background(), "key", fn)
+	g.Go(context.Background(), "key", fn)
+	if stats := g.Stats(); stats.Executed != 1 || stats.Coalesced != 1 || stats.InFlight != 1 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+	close(release)
+	if err := g.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("fn ran %d times, want 1", calls.Load())
+	}
+}
@@ -2,10 +2,70 @@ package database
 
 import (
 	"context"
+	"errors"
 	"time"
 )
 
+var ErrKeysNotSupported = errors.New("cache backend does not support listing keys")
+
+// Metadata is stored with every cache entry
+type Metadata struct {
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int    `json:"size"`
+	SourceUrl   string `json:"source_url"`
+	// ETag and LastModified are the origin validators of the source image
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Params       string `json:"params"`
+	// Digest is the sha256 of the stored data, served as the response ETag
+	Digest string `json:"digest,omitempty"`
+	// SourceDigest is the sha256 of the source image, it detects unchanged
+	// images on origins that don't support conditional requests
+	SourceDigest string    `json:"source_digest,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ValidatedAt is the last time the origin confirmed the source image didn't change
+	ValidatedAt time.Time `json:"validated_at"`
+}
+
+// Validated returns when the source image was last downloaded or revalidated
+func (m *Metadata) Validated() time.Time {
+	if m.ValidatedAt.After(m.CreatedAt) {
+		return m.ValidatedAt
+	}
+	return m.CreatedAt
+}
+
 type PkgDatabaseInterface interface {
-	Set(context.Context, string, []byte) error
-	Get(context.Context, string) ([]byte, *time.Time, error)
+	Set(context.Context, string, []byte, *Metadata) error
+	Get(context.Context, string) ([]byte, *Metadata, error)
+	Delete(context.Context, string) error
+	// Keys returns the stored keys starting with the prefix
+	Keys(context.Context, string) ([]string, error)
+	Ping(context.Context) error
+	Close() error
+}
+
+// PkgDatabaseTTL is implemented by the backends that can expire every entry
+// after its own TTL instead of the cache expiration
+type PkgDatabaseTTL interface {
+	// SetWithTTL stores the entry for ttl, 0 keeps it until it's evicted
+	SetWithTTL(ctx context.Context, key string, data []byte, meta *Metadata, ttl time.Duration) error
+}
+
+// PkgDatabaseSet is implemented by the backends that can't list their keys,
+// they track related keys in a set updated atomically instead
+type PkgDatabaseSet interface {
+	// AddMember adds the member to the set stored in key
+	AddMember(ctx context.Context, key, member string) error
+	// Members returns the members of the set stored in key
+	Members(ctx context.Context, key string) ([]string, error)
+}
+
+// PkgDatabaseMeta is implemented by the backends that can read the metadata
+// of an entry without reading its data
+type PkgDatabaseMeta interface {
+	// GetMeta returns the metadata of the entry, nil if it's not stored
+	GetMeta(ctx context.Context, key string) (*Metadata, error)
 }
@@ -1,49 +1,124 @@
 package database
 
 import (
+	"bytes"
+	"container/list"
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Every cache file starts with fileMagic, the sha256 of the rest of the file
+// and the metadata length, followed by the JSON metadata and the data.
+// Truncated or corrupted files are detected and discarded on read.
+var fileMagic = []byte("GPZC\x00\x00\x00\x02")
+
+const fileHeaderSize = 8 + sha256.Size + 4
+
+var errCorruptedFile = errors.New("corrupted cache file")
+
+type fileEntry struct {
+	key     string
+	path    string
+	size    int64
+	created time.Time
+}
+
+// PkgDatabaseFile stores every key in its own file, sharded in two levels
+// of subfolders by the key prefix. Access order is tracked in memory instead
+// of relying on atime, which is often disabled, to evict the least recently
+// used files when the cache is over maxBytes.
 type PkgDatabaseFile struct {
-	path string
+	path     string
+	maxBytes int64
+	maxAge   time.Duration
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	size     int64
+	done     chan struct{}
 }
 
-func NewDatabaseFile(path string) *PkgDatabaseFile {
+// NewDatabaseFile creates the file cache, maxBytes 0 means no size limit and
+// cacheExpiration 0 means files never expire
+func NewDatabaseFile(path string, maxBytes int64, cacheExpiration uint) *PkgDatabaseFile {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		log.Printf("Cache directory %s does not exist, creating it\n", path)
-		if err := os.Mkdir(path, os.ModePerm); err != nil {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
 			log.Fatalf("Error creating cache directory: %v\n", err)
 		}
 	}
-	return &PkgDatabaseFile{
-		path: path,
+	db := &PkgDatabaseFile{
+		path:     path,
+		maxBytes: maxBytes,
+		maxAge:   time.Minute * time.Duration(cacheExpiration),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		done:     make(chan struct{}),
+	}
+	if err := db.loadEntries(); err != nil {
+		log.Fatalf("Error reading cache directory: %v\n", err)
 	}
+	go db.janitor()
+	return db
 }
 
-func (db *PkgDatabaseFile) Set(ctx context.Context, key string, data []byte) error {
-	file, err := os.Create(fmt.Sprintf("%s/%s", db.path, key))
+func (db *PkgDatabaseFile) Set(ctx context.Context, key string, data []byte, meta *Metadata) error {
+	filePath := db.filePath(key)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, readers never see a partial file
+	file, err := os.CreateTemp(filepath.Dir(filePath), ".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-	_, err = file.Write(data)
+	defer os.Remove(file.Name())
+	fileData, err := encodeFile(data, meta)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(fileData)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// Renamed with the lock held, discard checks the file it removes is still
+	// the one it read
+	if err := os.Rename(file.Name(), filePath); err != nil {
+		return err
+	}
+	db.track(&fileEntry{
+		key:     key,
+		path:    filePath,
+		size:    int64(len(fileData)),
+		created: time.Now(),
+	})
+	db.evictOverQuota()
 	return nil
 }
 
-func (db *PkgDatabaseFile) Get(ctx context.Context, key string) ([]byte, *time.Time, error) {
-	filePath := fmt.Sprintf("%s/%s", db.path, key)
-	fileInfo, err := os.Stat(filePath)
-	if err != nil {
-		return nil, nil, nil
-	}
-	modTime := fileInfo.ModTime().UTC()
+func (db *PkgDatabaseFile) Get(ctx context.Context, key string) ([]byte, *Metadata, error) {
+	filePath := db.filePath(key)
 	file, err := os.Open(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -52,10 +127,272 @@ func (db *PkgDatabaseFile) Get(ctx context.Context, key string) ([]byte, *time.T
 		return nil, nil, err
 	}
 	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	modTime := fileInfo.ModTime().UTC()
+	if db.maxAge > 0 && time.Since(modTime) > db.maxAge {
+		db.discard(key, filePath, fileInfo)
+		return nil, nil, nil
+	}
+
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	imageData, meta, err := decodeFile(fileData)
+	if err != nil {
+		log.Printf("Discarding cache file %s: %v\n", filePath, err)
+		db.discard(key, filePath, fileInfo)
+		return nil, nil, nil
+	}
+
+	db.mu.Lock()
+	if element, ok := db.entries[key]; ok {
+		db.lru.MoveToFront(element)
+	} else {
+		// Written by another process sharing the directory
+		db.track(&fileEntry{key: key, path: filePath, size: fileInfo.Size(), created: modTime})
+	}
+	db.mu.Unlock()
+	return imageData, meta, nil
+}
+
+// GetMeta reads only the header and the metadata of the file, the checksum
+// is verified by Get when the data is read. It doesn't count as an access.
+func (db *PkgDatabaseFile) GetMeta(ctx context.Context, key string) (*Metadata, error) {
+	file, err := os.Open(db.filePath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if db.maxAge > 0 && time.Since(fileInfo.ModTime()) > db.maxAge {
+		return nil, nil
+	}
+	header := make([]byte, fileHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:len(fileMagic)], fileMagic) {
+		return nil, nil
+	}
+	metaLen := int64(binary.BigEndian.Uint32(header[fileHeaderSize-4:]))
+	if metaLen > fileInfo.Size()-fileHeaderSize {
+		return nil, nil
+	}
+	metaJson := make([]byte, metaLen)
+	if _, err := io.ReadFull(file, metaJson); err != nil {
+		return nil, nil
+	}
+	var meta Metadata
+	if err := json.Unmarshal(metaJson, &meta); err != nil {
+		return nil, nil
+	}
+	return &meta, nil
+}
+
+func (db *PkgDatabaseFile) Delete(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.delete(key, db.filePath(key))
+	return nil
+}
 
-	imageData, err := os.ReadFile(file.Name())
+// Keys lists the keys from the in memory index of the cache directory
+func (db *PkgDatabaseFile) Keys(ctx context.Context, prefix string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var keys []string
+	for key, element := range db.entries {
+		entry := element.Value.(*fileEntry)
+		if strings.HasPrefix(key, prefix) && entry.path == db.filePath(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// Ping checks the cache directory is writable
+func (db *PkgDatabaseFile) Ping(ctx context.Context) error {
+	file, err := os.CreateTemp(db.path, ".ping-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func (db *PkgDatabaseFile) Close() error {
+	close(db.done)
+	return nil
+}
+
+// filePath shards the keys in two levels of folders, <path>/ab/cd/abcd...
+func (db *PkgDatabaseFile) filePath(key string) string {
+	prefix := key
+	for len(prefix) < 4 {
+		prefix += "_"
+	}
+	return filepath.Join(db.path, prefix[:2], prefix[2:4], key)
+}
+
+// loadEntries indexes the files already in the cache directory, the least
+// recently modified ones are the first to be evicted
+func (db *PkgDatabaseFile) loadEntries() error {
+	var entries []*fileEntry
+	err := filepath.WalkDir(db.path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		// Leftovers from writes interrupted by a crash
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &fileEntry{
+			key:     d.Name(),
+			path:    path,
+			size:    info.Size(),
+			created: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(entries, func(a, b *fileEntry) int {
+		return a.created.Compare(b.created)
+	})
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, entry := range entries {
+		// Files from before the sharding live in the cache root and are only evicted
+		if entry.path != db.filePath(entry.key) {
+			entry.key = entry.path
+		}
+		db.track(entry)
+	}
+	log.Printf("File cache has %d files using %d bytes\n", len(db.entries), db.size)
+	db.evictOverQuota()
+	return nil
+}
+
+func encodeFile(data []byte, meta *Metadata) ([]byte, error) {
+	metaJson, err := json.Marshal(meta)
 	if err != nil {
-		return nil, &modTime, err
+		return nil, err
+	}
+	body := binary.BigEndian.AppendUint32(nil, uint32(len(metaJson)))
+	body = append(body, metaJson...)
+	body = append(body, data...)
+	checksum := sha256.Sum256(body)
+	return slices.Concat(fileMagic, checksum[:], body), nil
+}
+
+// decodeFile checks the file header and returns the data and metadata if the checksum matches
+func decodeFile(fileData []byte) ([]byte, *Metadata, error) {
+	if len(fileData) < fileHeaderSize || !bytes.Equal(fileData[:len(fileMagic)], fileMagic) {
+		return nil, nil, errCorruptedFile
+	}
+	checksumEnd := len(fileMagic) + sha256.Size
+	body := fileData[checksumEnd:]
+	checksum := sha256.Sum256(body)
+	if !bytes.Equal(fileData[len(fileMagic):checksumEnd], checksum[:]) {
+		return nil, nil, errCorruptedFile
+	}
+	metaLen := int(binary.BigEndian.Uint32(body))
+	if metaLen > len(body)-4 {
+		return nil, nil, errCorruptedFile
+	}
+	var meta Metadata
+	if err := json.Unmarshal(body[4:4+metaLen], &meta); err != nil {
+		return nil, nil, err
+	}
+	return body[4+metaLen:], &meta, nil
+}
+
+// track must be called with the lock held
+func (db *PkgDatabaseFile) track(entry *fileEntry) {
+	if element, ok := db.entries[entry.key]; ok {
+		db.size -= element.Value.(*fileEntry).size
+		db.lru.Remove(element)
+	}
+	db.entries[entry.key] = db.lru.PushFront(entry)
+	db.size += entry.size
+}
+
+// discard deletes the file read by Get, unless a concurrent Set replaced it
+// since it was opened
+func (db *PkgDatabaseFile) discard(key, filePath string, opened fs.FileInfo) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	current, err := os.Stat(filePath)
+	if err == nil && !os.SameFile(current, opened) {
+		return
+	}
+	db.delete(key, filePath)
+}
+
+// delete must be called with the lock held
+func (db *PkgDatabaseFile) delete(key, filePath string) {
+	if element, ok := db.entries[key]; ok {
+		db.size -= element.Value.(*fileEntry).size
+		db.lru.Remove(element)
+		delete(db.entries, key)
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		log.Printf("Error removing cache file %s: %v\n", filePath, err)
+	}
+}
+
+// evictOverQuota must be called with the lock held
+func (db *PkgDatabaseFile) evictOverQuota() {
+	for db.maxBytes > 0 && db.size > db.maxBytes && db.lru.Len() > 0 {
+		entry := db.lru.Back().Value.(*fileEntry)
+		db.delete(entry.key, entry.path)
+	}
+}
+
+// janitor removes the expired files and keeps the cache under its size limit
+func (db *PkgDatabaseFile) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
+		db.mu.Lock()
+		var expired int
+		if db.maxAge > 0 {
+			for _, element := range db.entries {
+				entry := element.Value.(*fileEntry)
+				if time.Since(entry.created) > db.maxAge {
+					db.delete(entry.key, entry.path)
+					expired++
+				}
+			}
+		}
+		db.evictOverQuota()
+		size, files := db.size, len(db.entries)
+		db.mu.Unlock()
+		if expired > 0 {
+			log.Printf("File cache removed %d expired files, %d files using %d bytes\n", expired, files, size)
+		}
 	}
-	return imageData, &modTime, nil
 }
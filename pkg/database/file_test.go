@@ -0,0 +1,220 @@
+package database
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fileSize is the size of a cache file holding the data with empty metadata
+func fileSize(t *testing.T, data []byte) int64 {
+	t.Helper()
+	fileData, err := encodeFile(data, &Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(fileData))
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func TestFileSharding(t *testing.T) {
+	dir := t.TempDir()
+	db := NewDatabaseFile(dir, 0, 0)
+	defer db.Close()
+	tests := []struct {
+		key  string
+		path string
+	}{
+		{"abcdef_80_100", filepath.Join(dir, "ab", "cd", "abcdef_80_100")},
+		{"abc", filepath.Join(dir, "ab", "c_", "abc")},
+		{"a", filepath.Join(dir, "a_", "__", "a")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if err := db.Set(context.Background(), tt.key, []byte("data"), &Metadata{}); err != nil {
+				t.Fatal(err)
+			}
+			if !exists(tt.path) {
+				t.Errorf("%s not stored at %s", tt.key, tt.path)
+			}
+			if data, _, _ := db.Get(context.Background(), tt.key); string(data) != "data" {
+				t.Errorf("Get() = %q, want data", data)
+			}
+		})
+	}
+}
+
+func TestFileDiscardsCorruptedFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(fileData []byte) []byte
+	}{
+		{"flipped data byte", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }},
+		{"flipped checksum byte", func(b []byte) []byte { b[len(fileMagic)] ^= 0xff; return b }},
+		{"truncated", func(b []byte) []byte { return b[:len(b)-2] }},
+		{"truncated header", func(b []byte) []byte { return b[:fileHeaderSize-1] }},
+		{"empty", func(b []byte) []byte { return nil }},
+		{"unknown version", func(b []byte) []byte { b[len(fileMagic)-1]++; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			db := NewDatabaseFile(t.TempDir(), 0, 0)
+			defer db.Close()
+			if err := db.Set(ctx, "key", []byte("image data"), &Metadata{ContentType: "image/png"}); err != nil {
+				t.Fatal(err)
+			}
+			path := db.filePath("key")
+			fileData, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(fileData), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			data, meta, err := db.Get(ctx, "key")
+			if data != nil || meta != nil || err != nil {
+				t.Errorf("Get() = %q, %v, %v, want a miss", data, meta, err)
+			}
+			if exists(path) {
+				t.Error("corrupted file not removed")
+			}
+			if db.size != 0 || len(db.entries) != 0 {
+				t.Errorf("index has %d entries and %d bytes, want none", len(db.entries), db.size)
+			}
+		})
+	}
+}
+
+func TestFileLoadEntries(t *testing.T) {
+	dir := t.TempDir()
+	shard := filepath.Join(dir, "ke", "y_")
+	if err := os.MkdirAll(shard, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	fileData, err := encodeFile([]byte("data"), &Metadata{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		// Interrupted write
+		filepath.Join(shard, ".tmp-123"): []byte("partial"),
+		filepath.Join(shard, "key_1"):    fileData,
+		// Flat layout from before the sharding
+		filepath.Join(dir, "legacy_1"): []byte("legacy image"),
+	}
+	for path, data := range files {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := NewDatabaseFile(dir, 0, 0)
+	defer db.Close()
+	if exists(filepath.Join(shard, ".tmp-123")) {
+		t.Error("temporary file not removed")
+	}
+	if data, _, _ := db.Get(context.Background(), "key_1"); string(data) != "data" {
+		t.Errorf("Get(key_1) = %q, want data", data)
+	}
+	// Legacy files are counted in the quota but never served or listed
+	if data, _, _ := db.Get(context.Background(), "legacy_1"); data != nil {
+		t.Errorf("Get(legacy_1) = %q, want a miss", data)
+	}
+	if keys, _ := db.Keys(context.Background(), ""); !slices.Equal(keys, []string{"key_1"}) {
+		t.Errorf("Keys() = %v, want [key_1]", keys)
+	}
+	if want := int64(len(fileData) + len("legacy image")); db.size != want {
+		t.Errorf("size = %d, want %d", db.size, want)
+	}
+}
+
+func TestFileQuotaEviction(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	// A legacy file modified long ago is the first to go
+	legacy := filepath.Join(dir, "legacy")
+	if err := os.WriteFile(legacy, []byte("legacy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(legacy, old, old); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789")
+	db := NewDatabaseFile(dir, 2*fileSize(t, data)+int64(len("legacy")), 0)
+	defer db.Close()
+
+	set := func(key string) {
+		if err := db.Set(ctx, key, data, &Metadata{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("key_a")
+	set("key_b")
+	if !exists(legacy) {
+		t.Fatal("legacy file evicted under the quota")
+	}
+	set("key_c")
+	if exists(legacy) {
+		t.Error("legacy file not evicted first")
+	}
+	// Reading key_b makes key_c the least recently used
+	db.Get(ctx, "key_b")
+	set("key_d")
+	for key, want := range map[string]bool{"key_a": false, "key_b": true, "key_c": false, "key_d": true} {
+		if exists(db.filePath(key)) != want {
+			t.Errorf("%s on disk = %v, want %v", key, !want, want)
+		}
+	}
+	if want := 2 * fileSize(t, data); db.size != want {
+		t.Errorf("size = %d, want %d", db.size, want)
+	}
+}
+
+func TestFileDiscardKeepsReplacedFile(t *testing.T) {
+	ctx := context.Background()
+	db := NewDatabaseFile(t.TempDir(), 0, 0)
+	defer db.Close()
+	if err := db.Set(ctx, "key", []byte("old"), &Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	// Get opened the old file and found it corrupted or expired while a
+	// concurrent Set renamed a new one in its place
+	opened, err := os.Stat(db.filePath("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(ctx, "key", []byte("new"), &Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	db.discard("key", db.filePath("key"), opened)
+
+	data, _, err := db.Get(ctx, "key")
+	if err != nil || string(data) != "new" {
+		t.Fatalf("Get() = %q, %v, want the new data", data, err)
+	}
+	info, err := os.Stat(db.filePath("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.size != info.Size() || len(db.entries) != 1 {
+		t.Errorf("index has %d entries and %d bytes, want 1 and %d", len(db.entries), db.size, info.Size())
+	}
+
+	// The file read is still in place, it's removed
+	db.discard("key", db.filePath("key"), info)
+	if _, err := os.Stat(db.filePath("key")); !os.IsNotExist(err) {
+		t.Errorf("file not removed: %v", err)
+	}
+	if db.size != 0 || len(db.entries) != 0 {
+		t.Errorf("index has %d entries and %d bytes, want none", len(db.entries), db.size)
+	}
+}
@@ -1,61 +1,204 @@
 package database
 
 import (
+	"container/list"
 	"context"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
 type InMemObject struct {
-	Data      []byte
-	CreatedAt time.Time
-	ExpireAt  time.Time
+	Key      string
+	Data     []byte
+	Meta     Metadata
+	ExpireAt time.Time
 }
 
+func (o *InMemObject) size() int64 {
+	return int64(len(o.Key) + len(o.Data))
+}
+
+type InMemStats struct {
+	Entries     int
+	Bytes       int64
+	MaxBytes    int64
+	Hits        uint64
+	Misses      uint64
+	Evictions   uint64
+	Expirations uint64
+}
+
+// PkgDatabaseInMemory is a LRU cache bounded by the total size of the
+// stored keys and data, safe for concurrent use
 type PkgDatabaseInMemory struct {
-	data            map[string]InMemObject
+	mu              sync.Mutex
+	items           map[string]*list.Element
+	lru             *list.List
+	size            int64
+	maxBytes        int64
 	cacheExpiration uint
+	stats           InMemStats
+	done            chan struct{}
 }
 
-func NewDatabaseInMemory(cacheExpiration uint) *PkgDatabaseInMemory {
+// NewDatabaseInMemory creates the cache, maxBytes 0 means no size limit
+func NewDatabaseInMemory(cacheExpiration uint, maxBytes int64) *PkgDatabaseInMemory {
 	dbInMem := &PkgDatabaseInMemory{
-		data:            make(map[string]InMemObject),
+		items:           make(map[string]*list.Element),
+		lru:             list.New(),
+		maxBytes:        maxBytes,
 		cacheExpiration: cacheExpiration,
+		done:            make(chan struct{}),
 	}
-	if cacheExpiration != 0 {
-		go dbInMem.checkExpiredData()
-	}
+	go dbInMem.checkExpiredData()
 
 	return dbInMem
 }
 
-func (db *PkgDatabaseInMemory) Set(ctx context.Context, key string, data []byte) error {
-	db.data[key] = InMemObject{
-		Data:      data,
-		CreatedAt: time.Now().UTC(),
-		ExpireAt:  time.Now().UTC().Add(time.Minute * time.Duration(db.cacheExpiration)),
+// Set stores the entry for the cache expiration
+func (db *PkgDatabaseInMemory) Set(ctx context.Context, key string, data []byte, meta *Metadata) error {
+	return db.SetWithTTL(ctx, key, data, meta, time.Minute*time.Duration(db.cacheExpiration))
+}
+
+// SetWithTTL stores the entry for its own TTL, 0 keeps it until it's evicted
+func (db *PkgDatabaseInMemory) SetWithTTL(ctx context.Context, key string, data []byte, meta *Metadata, ttl time.Duration) error {
+	object := &InMemObject{
+		Key:  key,
+		Data: data,
+		Meta: *meta,
+	}
+	if ttl > 0 {
+		object.ExpireAt = time.Now().UTC().Add(ttl)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	// The previous value is stale even if the new one can't be cached
+	if element, ok := db.items[key]; ok {
+		db.remove(element)
+	}
+	if db.maxBytes > 0 && object.size() > db.maxBytes {
+		log.Printf("Data %s is bigger than the cache max size, not caching it\n", key)
+		return nil
+	}
+	db.items[key] = db.lru.PushFront(object)
+	db.size += object.size()
+	for db.maxBytes > 0 && db.size > db.maxBytes {
+		db.remove(db.lru.Back())
+		db.stats.Evictions++
 	}
 	return nil
 }
 
-func (db *PkgDatabaseInMemory) Get(ctx context.Context, key string) ([]byte, *time.Time, error) {
-	data, ok := db.data[key]
+func (db *PkgDatabaseInMemory) Get(ctx context.Context, key string) ([]byte, *Metadata, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	element, ok := db.items[key]
 	if !ok {
+		db.stats.Misses++
 		return nil, nil, nil
 	}
-	return data.Data, &data.CreatedAt, nil
+	object := element.Value.(*InMemObject)
+	if !object.ExpireAt.IsZero() && time.Now().After(object.ExpireAt) {
+		db.remove(element)
+		db.stats.Expirations++
+		db.stats.Misses++
+		return nil, nil, nil
+	}
+	db.lru.MoveToFront(element)
+	db.stats.Hits++
+	meta := object.Meta
+	return object.Data, &meta, nil
+}
+
+// GetMeta doesn't count as an access, listing the cache keeps the LRU order
+func (db *PkgDatabaseInMemory) GetMeta(ctx context.Context, key string) (*Metadata, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	element, ok := db.items[key]
+	if !ok {
+		return nil, nil
+	}
+	object := element.Value.(*InMemObject)
+	if !object.ExpireAt.IsZero() && time.Now().After(object.ExpireAt) {
+		return nil, nil
+	}
+	meta := object.Meta
+	return &meta, nil
+}
+
+func (db *PkgDatabaseInMemory) Delete(ctx context.Context, key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if element, ok := db.items[key]; ok {
+		db.remove(element)
+	}
+	return nil
+}
+
+func (db *PkgDatabaseInMemory) Keys(ctx context.Context, prefix string) ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var keys []string
+	for key := range db.items {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (db *PkgDatabaseInMemory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (db *PkgDatabaseInMemory) Close() error {
+	close(db.done)
+	return nil
+}
+
+func (db *PkgDatabaseInMemory) Stats() InMemStats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := db.stats
+	stats.Entries = len(db.items)
+	stats.Bytes = db.size
+	stats.MaxBytes = db.maxBytes
+	return stats
+}
+
+// remove must be called with the lock held
+func (db *PkgDatabaseInMemory) remove(element *list.Element) {
+	object := db.lru.Remove(element).(*InMemObject)
+	delete(db.items, object.Key)
+	db.size -= object.size()
 }
 
 func (db *PkgDatabaseInMemory) checkExpiredData() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
 	for {
-		time.Sleep(time.Minute)
+		select {
+		case <-db.done:
+			return
+		case <-ticker.C:
+		}
 		log.Println("Checking for expired data")
-		for imageName, image := range db.data {
-			if time.Now().After(image.ExpireAt) {
-				log.Printf("Data %s expired\n", imageName)
-				delete(db.data, imageName)
+		now := time.Now()
+		db.mu.Lock()
+		for element := db.lru.Back(); element != nil; {
+			prev := element.Prev()
+			object := element.Value.(*InMemObject)
+			if !object.ExpireAt.IsZero() && now.After(object.ExpireAt) {
+				log.Printf("Data %s expired\n", object.Key)
+				db.remove(element)
+				db.stats.Expirations++
 			}
+			element = prev
 		}
+		db.mu.Unlock()
 		log.Println("Done checking for expired data")
 	}
 }
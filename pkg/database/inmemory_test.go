@@ -0,0 +1,145 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func set(t *testing.T, db *PkgDatabaseInMemory, key string, size int) {
+	t.Helper()
+	if err := db.Set(context.Background(), key, make([]byte, size), &Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func cached(db *PkgDatabaseInMemory, key string) bool {
+	data, _, _ := db.Get(context.Background(), key)
+	return data != nil
+}
+
+func TestInMemoryLRU(t *testing.T) {
+	// The cache holds 30 bytes, keys take 1 byte
+	tests := []struct {
+		name    string
+		run     func(db *PkgDatabaseInMemory)
+		present []string
+		absent  []string
+		bytes   int64
+	}{
+		{"oldest evicted", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "b", 9)
+			set(t, db, "c", 9)
+			set(t, db, "d", 9)
+		}, []string{"b", "c", "d"}, []string{"a"}, 30},
+		{"get refreshes", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "b", 9)
+			set(t, db, "c", 9)
+			cached(db, "a")
+			set(t, db, "d", 9)
+		}, []string{"a", "c", "d"}, []string{"b"}, 30},
+		{"big entry evicts several", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "b", 9)
+			set(t, db, "c", 9)
+			set(t, db, "d", 19)
+		}, []string{"c", "d"}, []string{"a", "b"}, 30},
+		{"overwrite keeps one entry", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "a", 4)
+			set(t, db, "b", 9)
+			set(t, db, "c", 9)
+		}, []string{"a", "b", "c"}, nil, 25},
+		{"oversized entry not cached", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "b", 30)
+		}, []string{"a"}, []string{"b"}, 10},
+		{"oversized entry drops the stale value", func(db *PkgDatabaseInMemory) {
+			set(t, db, "a", 9)
+			set(t, db, "b", 9)
+			set(t, db, "a", 30)
+		}, []string{"b"}, []string{"a"}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := NewDatabaseInMemory(0, 30)
+			defer db.Close()
+			tt.run(db)
+			if stats := db.Stats(); stats.Bytes != tt.bytes || stats.Entries != len(tt.present) {
+				t.Errorf("Stats() = %d entries and %d bytes, want %d and %d", stats.Entries, stats.Bytes, len(tt.present), tt.bytes)
+			}
+			for _, key := range tt.present {
+				if !cached(db, key) {
+					t.Errorf("%s evicted", key)
+				}
+			}
+			for _, key := range tt.absent {
+				if cached(db, key) {
+					t.Errorf("%s still cached", key)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryTTL(t *testing.T) {
+	ctx := context.Background()
+	db := NewDatabaseInMemory(0, 0)
+	defer db.Close()
+	db.SetWithTTL(ctx, "short", []byte("x"), &Metadata{}, 10*time.Millisecond)
+	db.SetWithTTL(ctx, "long", []byte("x"), &Metadata{}, time.Hour)
+	db.SetWithTTL(ctx, "forever", []byte("x"), &Metadata{}, 0)
+	db.Set(ctx, "default", []byte("x"), &Metadata{})
+	time.Sleep(20 * time.Millisecond)
+
+	for key, want := range map[string]bool{"short": false, "long": true, "forever": true, "default": true} {
+		if cached(db, key) != want {
+			t.Errorf("%s cached = %v, want %v", key, !want, want)
+		}
+	}
+	if stats := db.Stats(); stats.Expirations != 1 {
+		t.Errorf("Stats().Expirations = %d, want 1", stats.Expirations)
+	}
+}
+
+func TestInMemoryConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	db := NewDatabaseInMemory(0, 1000)
+	defer db.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key%d", (i*7+j)%50)
+				switch j % 4 {
+				case 0:
+					db.Set(ctx, key, make([]byte, j%40), &Metadata{})
+				case 1:
+					db.Get(ctx, key)
+				case 2:
+					db.Delete(ctx, key)
+				default:
+					db.Keys(ctx, "key1")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// The size accounting matches the entries left
+	keys, _ := db.Keys(ctx, "")
+	var size int64
+	for _, key := range keys {
+		data, _, _ := db.Get(ctx, key)
+		size += int64(len(key) + len(data))
+	}
+	if stats := db.Stats(); stats.Bytes != size || stats.Entries != len(keys) || stats.Bytes > 1000 {
+		t.Errorf("Stats() = %d entries and %d bytes, want %d and %d", stats.Entries, stats.Bytes, len(keys), size)
+	}
+}
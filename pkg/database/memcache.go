@@ -2,12 +2,13 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
-	"time"
+	"slices"
+	"strings"
 
 	"github.com/memcachier/mc/v3"
-	"github.com/redis/go-redis/v9"
 )
 
 type PkgDatabaseMemcache struct {
@@ -27,8 +28,12 @@ func NewDatabaseMemcache(host string, port int, username string, password string
 	}
 }
 
-func (db *PkgDatabaseMemcache) Set(ctx context.Context, key string, data []byte) error {
-	_, err := db.conn.Set(key+":created_at", time.Now().UTC().String(), 0, uint32(db.cacheExpiration*60), 0)
+func (db *PkgDatabaseMemcache) Set(ctx context.Context, key string, data []byte, meta *Metadata) error {
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = db.conn.Set(key+":meta", string(metaJson), 0, uint32(db.cacheExpiration*60), 0)
 	if err != nil {
 		return err
 	}
@@ -36,18 +41,93 @@ func (db *PkgDatabaseMemcache) Set(ctx context.Context, key string, data []byte)
 	return err
 }
 
-func (db *PkgDatabaseMemcache) Get(ctx context.Context, key string) ([]byte, *time.Time, error) {
-	modified, _, _, err := db.conn.Get(key + ":created_at")
+func (db *PkgDatabaseMemcache) Get(ctx context.Context, key string) ([]byte, *Metadata, error) {
+	metaJson, _, _, err := db.conn.Get(key + ":meta")
 	if err != nil {
 		if err != mc.ErrNotFound {
 			return nil, nil, err
 		}
 		return nil, nil, nil
 	}
-	modifiedTime, err := time.Parse("2006-01-02 15:04:05.999999999 -0700 MST", modified)
-	data, _, _, err := db.conn.Get(key)
-	if err != nil && err != redis.Nil {
+	var meta Metadata
+	if err := json.Unmarshal([]byte(metaJson), &meta); err != nil {
 		return nil, nil, err
 	}
-	return []byte(data), &modifiedTime, nil
+	data, _, _, err := db.conn.Get(key)
+	if err != nil {
+		if err != mc.ErrNotFound {
+			return nil, nil, err
+		}
+		return nil, nil, nil
+	}
+	return []byte(data), &meta, nil
+}
+
+func (db *PkgDatabaseMemcache) Delete(ctx context.Context, key string) error {
+	if err := db.conn.Del(key + ":meta"); err != nil && err != mc.ErrNotFound {
+		return err
+	}
+	if err := db.conn.Del(key); err != nil && err != mc.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// AddMember appends the member to a newline separated list, appends are
+// atomic so concurrent writers, even from other replicas, don't lose members.
+// Appends keep the expiration of the list, so it's touched to outlive the
+// member just added.
+func (db *PkgDatabaseMemcache) AddMember(ctx context.Context, key, member string) error {
+	ttl := uint32(db.cacheExpiration * 60)
+	for {
+		_, err := db.conn.Append(key, member+"\n", 0)
+		if err == nil {
+			_, err = db.conn.Touch(key, ttl)
+			if err != mc.ErrNotFound {
+				return err
+			}
+			// Expired between the append and the touch, create it again
+			continue
+		}
+		if err != mc.ErrNotFound && err != mc.ErrValueNotStored {
+			return err
+		}
+		_, err = db.conn.Add(key, member+"\n", 0, ttl)
+		if err != mc.ErrKeyExists {
+			return err
+		}
+		// Created by another writer in between, append to it
+	}
+}
+
+func (db *PkgDatabaseMemcache) Members(ctx context.Context, key string) ([]string, error) {
+	list, _, _, err := db.conn.Get(key)
+	if err != nil {
+		if err != mc.ErrNotFound {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var members []string
+	for _, member := range strings.Split(list, "\n") {
+		if member != "" && !slices.Contains(members, member) {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+// Keys is not supported, memcache has no way to list its keys
+func (db *PkgDatabaseMemcache) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return nil, ErrKeysNotSupported
+}
+
+func (db *PkgDatabaseMemcache) Ping(ctx context.Context) error {
+	_, err := db.conn.Stats()
+	return err
+}
+
+func (db *PkgDatabaseMemcache) Close() error {
+	db.conn.Quit()
+	return nil
 }
@@ -0,0 +1,181 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/memcachier/mc/v3"
+)
+
+const (
+	statusNotFound  = 0x01
+	statusKeyExists = 0x02
+	statusNotStored = 0x05
+)
+
+type fakeMemcacheItem struct {
+	value string
+	exp   uint32
+}
+
+// fakeMemcache speaks the subset of the memcache binary protocol used by
+// the list of members: get, add, append, touch and delete
+type fakeMemcache struct {
+	mu    sync.Mutex
+	items map[string]*fakeMemcacheItem
+}
+
+func newFakeMemcache(t *testing.T) (*fakeMemcache, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	fake := &fakeMemcache{items: map[string]*fakeMemcacheItem{}}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+	return fake, listener.Addr().String()
+}
+
+func (f *fakeMemcache) serve(conn net.Conn) {
+	defer conn.Close()
+	header := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		op := header[1]
+		keyLen := int(binary.BigEndian.Uint16(header[2:]))
+		extraLen := int(header[4])
+		body := make([]byte, binary.BigEndian.Uint32(header[8:]))
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		extras := body[:extraLen]
+		key := string(body[extraLen : extraLen+keyLen])
+		value := string(body[extraLen+keyLen:])
+
+		status, responseExtras, responseValue := f.handle(op, key, extras, value)
+		response := make([]byte, 24)
+		response[0] = 0x81
+		response[1] = op
+		response[4] = byte(len(responseExtras))
+		binary.BigEndian.PutUint16(response[6:], status)
+		binary.BigEndian.PutUint32(response[8:], uint32(len(responseExtras)+len(responseValue)))
+		copy(response[12:16], header[12:16])
+		response = append(response, responseExtras...)
+		response = append(response, responseValue...)
+		if _, err := conn.Write(response); err != nil || op == 0x07 {
+			return
+		}
+	}
+}
+
+func (f *fakeMemcache) handle(op byte, key string, extras []byte, value string) (uint16, []byte, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	item, ok := f.items[key]
+	switch op {
+	case 0x00: // get
+		if !ok {
+			return statusNotFound, nil, ""
+		}
+		return 0, make([]byte, 4), item.value
+	case 0x02: // add
+		if ok {
+			return statusKeyExists, nil, ""
+		}
+		f.items[key] = &fakeMemcacheItem{value: value, exp: binary.BigEndian.Uint32(extras[4:])}
+	case 0x0e: // append
+		if !ok {
+			return statusNotStored, nil, ""
+		}
+		item.value += value
+	case 0x1c: // touch
+		if !ok {
+			return statusNotFound, nil, ""
+		}
+		item.exp = binary.BigEndian.Uint32(extras)
+	case 0x04: // delete
+		if !ok {
+			return statusNotFound, nil, ""
+		}
+		delete(f.items, key)
+	}
+	return 0, nil, ""
+}
+
+func (f *fakeMemcache) item(key string) fakeMemcacheItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if item, ok := f.items[key]; ok {
+		return *item
+	}
+	return fakeMemcacheItem{}
+}
+
+func newTestMemcache(t *testing.T) (*PkgDatabaseMemcache, *fakeMemcache) {
+	t.Helper()
+	fake, addr := newFakeMemcache(t)
+	db := &PkgDatabaseMemcache{conn: mc.NewMC(addr, "", ""), cacheExpiration: 10}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+func TestMemcacheMembers(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestMemcache(t)
+	members, err := db.Members(ctx, "hash_index")
+	if err != nil || members != nil {
+		t.Fatalf("Members() of a missing set = %v, %v, want nil", members, err)
+	}
+	for _, member := range []string{"hash_a", "hash_b", "hash_a"} {
+		if err := db.AddMember(ctx, "hash_index", member); err != nil {
+			t.Fatal(err)
+		}
+	}
+	members, err = db.Members(ctx, "hash_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"hash_a", "hash_b"}; !slices.Equal(members, want) {
+		t.Errorf("Members() = %v, want %v", members, want)
+	}
+	if item := fake.item("hash_index"); item.value != "hash_a\nhash_b\nhash_a\n" {
+		t.Errorf("stored list = %q", item.value)
+	}
+}
+
+func TestMemcacheAddMemberRefreshesTTL(t *testing.T) {
+	ctx := context.Background()
+	db, fake := newTestMemcache(t)
+	if err := db.AddMember(ctx, "hash_index", "hash_a"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := fake.item("hash_index").exp; exp != 600 {
+		t.Fatalf("expiration of the new list = %d, want 600", exp)
+	}
+	// The list is about to expire while its new member is stored for the full expiration
+	fake.mu.Lock()
+	fake.items["hash_index"].exp = 1
+	fake.mu.Unlock()
+	if err := db.AddMember(ctx, "hash_index", "hash_b"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := fake.item("hash_index").exp; exp != 600 {
+		t.Errorf("expiration after an append = %d, want 600", exp)
+	}
+}
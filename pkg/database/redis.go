@@ -2,8 +2,10 @@ package database
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -29,25 +31,73 @@ func NewDatabaseRedis(host string, port int, password string, db int, ce uint) *
 	}
 }
 
-func (db *PkgDatabaseRedis) Set(ctx context.Context, key string, data []byte) error {
-	err := db.conn.Set(ctx, key+":created_at", time.Now().UTC(), time.Minute*time.Duration(db.cacheExpiration)).Err()
+func (db *PkgDatabaseRedis) Set(ctx context.Context, key string, data []byte, meta *Metadata) error {
+	metaJson, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = db.conn.Set(ctx, key+":meta", metaJson, time.Minute*time.Duration(db.cacheExpiration)).Err()
 	if err != nil {
 		return err
 	}
 	return db.conn.Set(ctx, key, data, time.Minute*time.Duration(db.cacheExpiration)).Err()
 }
 
-func (db *PkgDatabaseRedis) Get(ctx context.Context, key string) ([]byte, *time.Time, error) {
-	modified, err := db.conn.Get(ctx, key+":created_at").Time()
+func (db *PkgDatabaseRedis) Get(ctx context.Context, key string) ([]byte, *Metadata, error) {
+	metaJson, err := db.conn.Get(ctx, key+":meta").Bytes()
 	if err != nil {
 		if err != redis.Nil {
 			return nil, nil, err
 		}
 		return nil, nil, nil
 	}
+	var meta Metadata
+	if err := json.Unmarshal(metaJson, &meta); err != nil {
+		return nil, nil, err
+	}
 	data, err := db.conn.Get(ctx, key).Bytes()
 	if err != nil && err != redis.Nil {
 		return nil, nil, err
 	}
-	return data, &modified, nil
+	return data, &meta, nil
+}
+
+func (db *PkgDatabaseRedis) GetMeta(ctx context.Context, key string) (*Metadata, error) {
+	metaJson, err := db.conn.Get(ctx, key+":meta").Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	var meta Metadata
+	if err := json.Unmarshal(metaJson, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (db *PkgDatabaseRedis) Delete(ctx context.Context, key string) error {
+	return db.conn.Del(ctx, key, key+":meta").Err()
+}
+
+func (db *PkgDatabaseRedis) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	iter := db.conn.Scan(ctx, 0, redisGlobEscaper.Replace(prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if key := iter.Val(); !strings.HasSuffix(key, ":meta") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, iter.Err()
+}
+
+var redisGlobEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+func (db *PkgDatabaseRedis) Ping(ctx context.Context) error {
+	return db.conn.Ping(ctx).Err()
+}
+
+func (db *PkgDatabaseRedis) Close() error {
+	return db.conn.Close()
 }
@@ -1,48 +1,109 @@
 package imagecompress
 
 import (
+	"math"
+
 	"github.com/davidbyttow/govips/v2/vips"
 )
 
 type PkgImgGoVips struct {
+	limits  SourceLimits
+	jxl     JxlOptions
+	formats map[string]bool
+}
+
+var vipsTypes = map[string]vips.ImageType{
+	"image/jpeg": vips.ImageTypeJPEG,
+	"image/png":  vips.ImageTypePNG,
+	"image/gif":  vips.ImageTypeGIF,
+	"image/webp": vips.ImageTypeWEBP,
+	"image/avif": vips.ImageTypeAVIF,
+	"image/jxl":  vips.ImageTypeJXL,
+}
+
+// VipsConfig holds the libvips settings, negative values keep the libvips defaults
+type VipsConfig struct {
+	Concurrency   int
+	MaxCacheFiles int
+	MaxCacheMem   int
+	MaxCacheSize  int
 }
 
-func NewImageGoVips() *PkgImgGoVips {
+// JxlOptions tunes the JPEG XL encoder
+type JxlOptions struct {
+	// Effort from 1 (fastest) to 9 (smallest)
+	Effort int
+	// Distance is the Butteraugli distance, 0 derives it from the quality
+	Distance float64
+}
+
+func NewImageGoVips(c VipsConfig, l SourceLimits, j JxlOptions) *PkgImgGoVips {
 	vips.LoggingSettings(nil, vips.LogLevelError)
-	vips.Startup(nil)
-	return &PkgImgGoVips{}
+	vips.Startup(&vips.Config{
+		ConcurrencyLevel: c.Concurrency,
+		MaxCacheFiles:    c.MaxCacheFiles,
+		MaxCacheMem:      c.MaxCacheMem,
+		MaxCacheSize:     c.MaxCacheSize,
+	})
+	// Formats depend on the libraries libvips was built with
+	formats := make(map[string]bool)
+	for _, format := range OutputFormats {
+		formats[format] = vips.IsTypeSupported(vipsTypes[format])
+	}
+	return &PkgImgGoVips{
+		limits:  l,
+		jxl:     j,
+		formats: formats,
+	}
 }
 
 func (ic *PkgImgGoVips) CloseVips() {
 	vips.Shutdown()
 }
 
-func (ic *PkgImgGoVips) CompressImage(c *CompressImageRequest) ([]byte, error) {
-	importParams := vips.NewImportParams()
-	importParams.NumPages.Set(-1) // Load all Gif Frames
-	img, err := vips.LoadImageFromBuffer(c.ImageData, importParams)
+// Check encodes a tiny image to make sure libvips is working
+func (ic *PkgImgGoVips) Check() error {
+	img, err := vips.Black(1, 1)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer img.Close()
+	_, _, err = img.ExportPng(vips.NewPngExportParams())
+	return err
+}
 
-	var vScale float64 = -1
-	if c.Height != 0 {
-		h := c.Height
-		if h > img.Height() {
-			h = img.Height()
-		}
-		vScale = float64(h) / float64(img.Height())
+func (ic *PkgImgGoVips) SupportsFormat(format string) bool {
+	return ic.formats[format]
+}
+
+func (ic *PkgImgGoVips) CompressImage(c *CompressImageRequest) (*CompressImageResponse, error) {
+	if err := ic.checkSourceLimits(c.ImageData); err != nil {
+		return nil, err
 	}
-	w := c.Width
-	if w > img.Width() {
-		w = img.Width()
+
+	importParams := vips.NewImportParams()
+	// Load all the animation frames, the pages of other formats like TIFF
+	// or HEIF collections may have different sizes and only the first is used
+	if imageType := vips.DetermineImageType(c.ImageData); imageType == vips.ImageTypeGIF || imageType == vips.ImageTypeWEBP {
+		importParams.NumPages.Set(-1)
+	}
+	if c.ImageType == "image/svg+xml" {
+		density, err := ic.svgDensity(c)
+		if err != nil {
+			return nil, err
+		}
+		importParams.Density.Set(density)
 	}
-	hScale := float64(w) / float64(img.Width())
-	err = img.ResizeWithVScale(hScale, vScale, vips.KernelAuto)
+	img, err := vips.LoadImageFromBuffer(c.ImageData, importParams)
 	if err != nil {
 		return nil, err
 	}
+	defer img.Close()
+	sourceWidth, sourceHeight := img.Width(), img.PageHeight()
+
+	if err := ic.resize(img, c); err != nil {
+		return nil, err
+	}
 
 	var newImage []byte
 
@@ -63,6 +124,15 @@ func (ic *PkgImgGoVips) CompressImage(c *CompressImageRequest) ([]byte, error) {
 		p := vips.NewAvifExportParams()
 		p.Quality = c.Quality
 		newImage, _, err = img.ExportAvif(p)
+	case "image/jxl":
+		p := vips.NewJxlExportParams()
+		p.Quality = c.Quality
+		p.Effort = ic.jxl.Effort
+		p.Distance = ic.jxl.Distance
+		if p.Distance == 0 {
+			p.Distance = jxlDistance(c.Quality)
+		}
+		newImage, _, err = img.ExportJxl(p)
 	default:
 		p := vips.NewWebpExportParams()
 		p.Quality = c.Quality
@@ -71,5 +141,166 @@ func (ic *PkgImgGoVips) CompressImage(c *CompressImageRequest) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newImage, err
+	return &CompressImageResponse{
+		ImageData:    newImage,
+		Width:        img.Width(),
+		Height:       img.PageHeight(),
+		SourceWidth:  sourceWidth,
+		SourceHeight: sourceHeight,
+	}, nil
+}
+
+// jxlDistance maps a quality to the Butteraugli distance the same way
+// libvips does, govips always sends the distance so the quality is ignored
+func jxlDistance(quality int) float64 {
+	q := float64(quality)
+	if q >= 30 {
+		return 0.1 + (100-q)*0.09
+	}
+	return 6.4 + math.Pow(2.5, (30-q)/5)/6.25
+}
+
+// checkSourceLimits reads only the image header, libvips loads lazily so
+// nothing is decoded before the dimensions are known to be safe. The header
+// is parsed in Go first, govips decodes some formats before libvips sees them.
+func (ic *PkgImgGoVips) checkSourceLimits(data []byte) error {
+	if err := ic.limits.checkHeader(data); err != nil {
+		return err
+	}
+	img, err := vips.LoadImageFromBuffer(data, nil)
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+	return ic.limits.check(img.Width(), img.PageHeight(), img.Pages())
+}
+
+// svgDensity returns the dpi to render the SVG at so the requested size is
+// reached without upscaling the raster, the resize does the exact fit after
+func (ic *PkgImgGoVips) svgDensity(c *CompressImageRequest) (int, error) {
+	img, err := vips.LoadImageFromBuffer(c.ImageData, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer img.Close()
+
+	width, height := float64(img.Width()), float64(img.Height())
+	scale := 1.0
+	if c.Width > 0 {
+		scale = float64(c.Width) / width
+	}
+	if c.Height > 0 && (c.Width == 0 || float64(c.Height)/height > scale) {
+		scale = float64(c.Height) / height
+	}
+	renderWidth, renderHeight := int(math.Ceil(width*scale)), int(math.Ceil(height*scale))
+	if err := ic.limits.check(renderWidth, renderHeight, 1); err != nil {
+		return 0, err
+	}
+	// 72 is the libvips default density, where one SVG unit is one pixel
+	return max(int(math.Ceil(72*scale)), 1), nil
+}
+
+// resize scales the image to the requested size following the fit mode.
+// Images are never enlarged.
+func (ic *PkgImgGoVips) resize(img *vips.ImageRef, c *CompressImageRequest) error {
+	srcWidth := float64(img.Width())
+	// Animated images are stored as a tall strip of frames
+	srcHeight := float64(img.PageHeight())
+	w := float64(c.Width)
+	h := float64(c.Height)
+
+	if c.Height == 0 {
+		return img.Resize(math.Min(w/srcWidth, 1), vips.KernelAuto)
+	}
+
+	switch c.Fit {
+	case FitFill:
+		return img.ResizeWithVScale(math.Min(w/srcWidth, 1), math.Min(h/srcHeight, 1), vips.KernelAuto)
+	case FitInside:
+		return img.Resize(math.Min(math.Min(w/srcWidth, h/srcHeight), 1), vips.KernelAuto)
+	case FitOutside:
+		return img.Resize(math.Min(math.Max(w/srcWidth, h/srcHeight), 1), vips.KernelAuto)
+	case FitContain:
+		canvasWidth, canvasHeight := ic.canvasSize(c.Width, c.Height)
+		w, h = float64(canvasWidth), float64(canvasHeight)
+		if err := img.Resize(math.Min(math.Min(w/srcWidth, h/srcHeight), 1), vips.KernelAuto); err != nil {
+			return err
+		}
+		if c.NewType != "image/jpeg" && !img.HasAlpha() {
+			if err := img.AddAlpha(); err != nil {
+				return err
+			}
+		}
+		left, top := position(c, img.Width(), img.PageHeight(), canvasWidth, canvasHeight)
+		return img.EmbedBackgroundRGBA(-left, -top, canvasWidth, canvasHeight, &vips.ColorRGBA{R: 255, G: 255, B: 255, A: 0})
+	default:
+		if err := img.Resize(math.Min(math.Max(w/srcWidth, h/srcHeight), 1), vips.KernelAuto); err != nil {
+			return err
+		}
+		cropWidth := min(c.Width, img.Width())
+		cropHeight := min(c.Height, img.PageHeight())
+		if cropWidth == img.Width() && cropHeight == img.PageHeight() {
+			return nil
+		}
+		// SmartCrop doesn't support animated images, those fall back to the center
+		if c.Gravity == GravitySmart && img.Pages() == 1 {
+			return img.SmartCrop(cropWidth, cropHeight, vips.InterestingAttention)
+		}
+		left, top := position(c, img.Width(), img.PageHeight(), cropWidth, cropHeight)
+		return img.ExtractArea(left, top, cropWidth, cropHeight)
+	}
+}
+
+// canvasSize scales the requested canvas down, keeping its aspect ratio,
+// until it fits the source limits
+func (ic *PkgImgGoVips) canvasSize(width, height int) (int, int) {
+	scale := 1.0
+	if ic.limits.MaxSide > 0 {
+		scale = math.Min(scale, float64(ic.limits.MaxSide)/float64(max(width, height)))
+	}
+	if ic.limits.MaxPixels > 0 {
+		scale = math.Min(scale, math.Sqrt(float64(ic.limits.MaxPixels)/(float64(width)*float64(height))))
+	}
+	if scale >= 1 {
+		return width, height
+	}
+	return max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1)
+}
+
+// position returns the offset of a width x height area inside the image
+// according to the gravity. When the area is bigger than the image the
+// offsets are negative.
+func position(c *CompressImageRequest, imgWidth, imgHeight, width, height int) (int, int) {
+	dx := imgWidth - width
+	dy := imgHeight - height
+	left, top := dx/2, dy/2
+	switch c.Gravity {
+	case GravityNorth:
+		top = 0
+	case GravityNorthEast:
+		left, top = dx, 0
+	case GravityEast:
+		left = dx
+	case GravitySouthEast:
+		left, top = dx, dy
+	case GravitySouth:
+		top = dy
+	case GravitySouthWest:
+		left, top = 0, dy
+	case GravityWest:
+		left = 0
+	case GravityNorthWest:
+		left, top = 0, 0
+	case GravityFocalPoint:
+		if dx < 0 || dy < 0 {
+			break
+		}
+		left = clamp(int(c.FocalX*float64(imgWidth))-width/2, 0, dx)
+		top = clamp(int(c.FocalY*float64(imgHeight))-height/2, 0, dy)
+	}
+	return left, top
+}
+
+func clamp(v, lo, hi int) int {
+	return max(lo, min(v, hi))
 }
@@ -1,5 +1,53 @@
 package imagecompress
 
+import "errors"
+
+var ErrImageTooLarge = errors.New("source image dimensions too large")
+
+const (
+	// FitCover resizes to fill both dimensions and crops the overflow using the gravity
+	FitCover = "cover"
+	// FitContain resizes to fit inside both dimensions and pads the rest using the gravity
+	FitContain = "contain"
+	// FitFill ignores the aspect ratio and stretches the image to both dimensions
+	FitFill = "fill"
+	// FitInside resizes to fit inside both dimensions, no crop and no padding
+	FitInside = "inside"
+	// FitOutside resizes to cover both dimensions, no crop and no padding
+	FitOutside = "outside"
+)
+
+const (
+	GravityCenter    = "center"
+	GravityNorth     = "north"
+	GravityNorthEast = "northeast"
+	GravityEast      = "east"
+	GravitySouthEast = "southeast"
+	GravitySouth     = "south"
+	GravitySouthWest = "southwest"
+	GravityWest      = "west"
+	GravityNorthWest = "northwest"
+	// GravitySmart crops around the most interesting area using libvips attention strategy
+	GravitySmart = "smart"
+	// GravityFocalPoint crops around FocalX and FocalY
+	GravityFocalPoint = "fp"
+)
+
+// OutputFormats are the formats the images can be converted to, if the
+// libvips build supports them
+var OutputFormats = []string{"image/jpeg", "image/png", "image/gif", "image/webp", "image/avif", "image/jxl"}
+
+// NegotiatedFormats are the output formats served only to the clients listing
+// them in the Accept header, other formats are kept as they are
+var NegotiatedFormats = []string{"image/avif", "image/webp", "image/jxl"}
+
+var Fits = []string{FitCover, FitContain, FitFill, FitInside, FitOutside}
+
+var Gravities = []string{
+	GravityCenter, GravityNorth, GravityNorthEast, GravityEast, GravitySouthEast,
+	GravitySouth, GravitySouthWest, GravityWest, GravityNorthWest, GravitySmart, GravityFocalPoint,
+}
+
 type CompressImageRequest struct {
 	ImageData []byte
 	ImageType string
@@ -7,8 +55,27 @@ type CompressImageRequest struct {
 	Width     int
 	Height    int
 	NewType   string
+	Fit       string
+	Gravity   string
+	// FocalX and FocalY are relative coordinates from 0 to 1, used with GravityFocalPoint
+	FocalX float64
+	FocalY float64
+}
+
+type CompressImageResponse struct {
+	ImageData []byte
+	// Width and Height of the new image, for animations the size of a frame
+	Width  int
+	Height int
+	// SourceWidth and SourceHeight are the original image size
+	SourceWidth  int
+	SourceHeight int
 }
 
 type PkgImgCompressInterface interface {
-	CompressImage(*CompressImageRequest) ([]byte, error)
+	CompressImage(*CompressImageRequest) (*CompressImageResponse, error)
+	// Check verifies the image library is able to encode images
+	Check() error
+	// SupportsFormat reports if images can be converted to the format
+	SupportsFormat(string) bool
 }
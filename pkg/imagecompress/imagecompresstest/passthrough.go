@@ -0,0 +1,15 @@
+package imagecompresstest
+
+import "github.com/patrickn2/go-image-optimizer/pkg/imagecompress"
+
+// Passthrough returns the source image as it is, for the tests that only
+// exercise the caching and the HTTP semantics
+type Passthrough struct{}
+
+func (Passthrough) CompressImage(c *imagecompress.CompressImageRequest) (*imagecompress.CompressImageResponse, error) {
+	return &imagecompress.CompressImageResponse{ImageData: c.ImageData, Width: c.Width, Height: c.Height}, nil
+}
+
+func (Passthrough) Check() error { return nil }
+
+func (Passthrough) SupportsFormat(format string) bool { return true }
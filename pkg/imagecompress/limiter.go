@@ -0,0 +1,72 @@
+package imagecompress
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrQueueFull    = errors.New("image processing queue is full")
+	ErrQueueTimeout = errors.New("image processing queue timeout")
+)
+
+// PkgImgLimiter limits how many images are compressed at the same time,
+// requests over the limit wait in a bounded queue
+type PkgImgLimiter struct {
+	ic           PkgImgCompressInterface
+	slots        chan struct{}
+	queueSize    int64
+	queueTimeout time.Duration
+	waiting      atomic.Int64
+}
+
+func NewImageLimiter(ic PkgImgCompressInterface, concurrency, queueSize int, queueTimeout time.Duration) *PkgImgLimiter {
+	return &PkgImgLimiter{
+		ic:           ic,
+		slots:        make(chan struct{}, concurrency),
+		queueSize:    int64(queueSize),
+		queueTimeout: queueTimeout,
+	}
+}
+
+func (l *PkgImgLimiter) CompressImage(c *CompressImageRequest) (*CompressImageResponse, error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if l.waiting.Add(1) > l.queueSize {
+			l.waiting.Add(-1)
+			return nil, ErrQueueFull
+		}
+		timer := time.NewTimer(l.queueTimeout)
+		select {
+		case l.slots <- struct{}{}:
+			timer.Stop()
+			l.waiting.Add(-1)
+		case <-timer.C:
+			l.waiting.Add(-1)
+			return nil, ErrQueueTimeout
+		}
+	}
+	defer func() { <-l.slots }()
+	return l.ic.CompressImage(c)
+}
+
+// Check bypasses the queue, health checks must not wait behind the images
+func (l *PkgImgLimiter) Check() error {
+	return l.ic.Check()
+}
+
+func (l *PkgImgLimiter) SupportsFormat(format string) bool {
+	return l.ic.SupportsFormat(format)
+}
+
+// Running returns the number of images being compressed right now
+func (l *PkgImgLimiter) Running() int {
+	return len(l.slots)
+}
+
+// Waiting returns the number of images waiting in the queue
+func (l *PkgImgLimiter) Waiting() int {
+	return int(l.waiting.Load())
+}
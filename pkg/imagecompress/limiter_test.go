@@ -0,0 +1,112 @@
+package imagecompress
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingCompressor holds every compression until release is closed
+type blockingCompressor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func newBlockingCompressor() *blockingCompressor {
+	return &blockingCompressor{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (b *blockingCompressor) CompressImage(c *CompressImageRequest) (*CompressImageResponse, error) {
+	b.started <- struct{}{}
+	<-b.release
+	return &CompressImageResponse{ImageData: c.ImageData}, nil
+}
+
+func (b *blockingCompressor) Check() error { return nil }
+
+func (b *blockingCompressor) SupportsFormat(format string) bool { return true }
+
+// compressAsync runs a compression in background and returns its error
+func compressAsync(l *PkgImgLimiter) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.CompressImage(&CompressImageRequest{})
+		done <- err
+	}()
+	return done
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLimiterQueueFull(t *testing.T) {
+	ic := newBlockingCompressor()
+	l := NewImageLimiter(ic, 1, 1, time.Minute)
+
+	running := compressAsync(l)
+	<-ic.started
+	queued := compressAsync(l)
+	waitFor(t, func() bool { return l.Waiting() == 1 })
+
+	if _, err := l.CompressImage(&CompressImageRequest{}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("CompressImage() error = %v, want ErrQueueFull", err)
+	}
+	if l.Running() != 1 || l.Waiting() != 1 {
+		t.Errorf("Running() = %d, Waiting() = %d, want 1 and 1", l.Running(), l.Waiting())
+	}
+
+	close(ic.release)
+	for _, done := range []<-chan error{running, queued} {
+		if err := <-done; err != nil {
+			t.Errorf("CompressImage() error = %v", err)
+		}
+	}
+	if l.Running() != 0 || l.Waiting() != 0 {
+		t.Errorf("Running() = %d, Waiting() = %d after the release, want 0", l.Running(), l.Waiting())
+	}
+}
+
+func TestLimiterQueueTimeout(t *testing.T) {
+	ic := newBlockingCompressor()
+	l := NewImageLimiter(ic, 1, 1, 10*time.Millisecond)
+
+	running := compressAsync(l)
+	<-ic.started
+	if _, err := l.CompressImage(&CompressImageRequest{}); !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("CompressImage() error = %v, want ErrQueueTimeout", err)
+	}
+	if l.Waiting() != 0 {
+		t.Errorf("Waiting() = %d after the timeout, want 0", l.Waiting())
+	}
+
+	close(ic.release)
+	if err := <-running; err != nil {
+		t.Errorf("CompressImage() error = %v", err)
+	}
+}
+
+func TestLimiterNoQueue(t *testing.T) {
+	ic := newBlockingCompressor()
+	l := NewImageLimiter(ic, 2, 0, time.Minute)
+
+	first, second := compressAsync(l), compressAsync(l)
+	<-ic.started
+	<-ic.started
+	if _, err := l.CompressImage(&CompressImageRequest{}); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("CompressImage() error = %v, want ErrQueueFull", err)
+	}
+	close(ic.release)
+	for _, done := range []<-chan error{first, second} {
+		if err := <-done; err != nil {
+			t.Errorf("CompressImage() error = %v", err)
+		}
+	}
+}
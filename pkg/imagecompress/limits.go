@@ -0,0 +1,42 @@
+package imagecompress
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/imageformat"
+)
+
+// SourceLimits bounds the decoded size of the source images, 0 disables a limit
+type SourceLimits struct {
+	MaxPixels int
+	MaxFrames int
+	MaxSide   int
+}
+
+// checkHeader checks the dimensions read from the image header, before any
+// decoder runs. Formats the header parser doesn't know are left to libvips,
+// except BMP images which govips decodes in Go before libvips sees them.
+func (l SourceLimits) checkHeader(data []byte) error {
+	info, err := imageformat.Probe(data)
+	if errors.Is(err, imageformat.ErrInvalidHeader) && imageformat.Detect(data) == imageformat.BMP {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+	return l.check(info.Width, info.Height, 1)
+}
+
+func (l SourceLimits) check(width, height, frames int) error {
+	if l.MaxSide > 0 && (width > l.MaxSide || height > l.MaxSide) {
+		return fmt.Errorf("%w: %dx%d exceeds max side %d", ErrImageTooLarge, width, height, l.MaxSide)
+	}
+	if l.MaxPixels > 0 && width*height > l.MaxPixels {
+		return fmt.Errorf("%w: %dx%d exceeds max pixels %d", ErrImageTooLarge, width, height, l.MaxPixels)
+	}
+	if l.MaxFrames > 0 && frames > l.MaxFrames {
+		return fmt.Errorf("%w: %d frames exceeds max frames %d", ErrImageTooLarge, frames, l.MaxFrames)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package imagecompress
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/imageformat"
+)
+
+// pngHeader builds the signature and IHDR chunk of a PNG, the pixel data is
+// never read
+func pngHeader(width, height uint32) []byte {
+	data := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	data = binary.BigEndian.AppendUint32(data, width)
+	data = binary.BigEndian.AppendUint32(data, height)
+	return append(data, 8, 6, 0, 0, 0, 0, 0, 0, 0)
+}
+
+func gifHeader(width, height uint16) []byte {
+	data := []byte("GIF89a")
+	data = binary.LittleEndian.AppendUint16(data, width)
+	data = binary.LittleEndian.AppendUint16(data, height)
+	return append(data, 0, 0, 0)
+}
+
+// bmpHeader builds the file header and a BITMAPINFOHEADER of a BMP
+func bmpHeader(width, height uint32) []byte {
+	data := []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00")
+	data = binary.LittleEndian.AppendUint32(data, 40)
+	data = binary.LittleEndian.AppendUint32(data, width)
+	data = binary.LittleEndian.AppendUint32(data, height)
+	return append(data, make([]byte, 28)...)
+}
+
+func TestCheckHeader(t *testing.T) {
+	limits := SourceLimits{MaxSide: 1000, MaxPixels: 500000}
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"within limits", pngHeader(1000, 500), nil},
+		{"width over max side", pngHeader(1001, 10), ErrImageTooLarge},
+		{"height over max side", gifHeader(10, 1001), ErrImageTooLarge},
+		{"over max pixels", pngHeader(800, 800), ErrImageTooLarge},
+		{"huge header", pngHeader(1<<31-1, 1<<31-1), ErrImageTooLarge},
+		{"bmp over max pixels", bmpHeader(800, 800), ErrImageTooLarge},
+		{"bmp within limits", bmpHeader(100, 100), nil},
+		// govips decodes BMP in Go before any libvips limit applies
+		{"invalid bmp header", bmpHeader(100, 100)[:30], imageformat.ErrInvalidHeader},
+		{"unknown format is left to libvips", []byte("not an image"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := limits.checkHeader(tt.data); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkHeader() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name                 string
+		limits               SourceLimits
+		width, height, pages int
+		wantErr              error
+	}{
+		{"no limits", SourceLimits{}, 100000, 100000, 1000, nil},
+		{"max side", SourceLimits{MaxSide: 100}, 100, 101, 1, ErrImageTooLarge},
+		{"max pixels", SourceLimits{MaxPixels: 10000}, 100, 101, 1, ErrImageTooLarge},
+		{"max pixels reached", SourceLimits{MaxPixels: 10000}, 100, 100, 1, nil},
+		{"max frames", SourceLimits{MaxFrames: 10}, 10, 10, 11, ErrImageTooLarge},
+		{"max frames reached", SourceLimits{MaxFrames: 10}, 10, 10, 10, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.limits.check(tt.width, tt.height, tt.pages); !errors.Is(err, tt.wantErr) {
+				t.Errorf("check() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
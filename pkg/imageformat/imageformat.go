@@ -0,0 +1,157 @@
+package imageformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"slices"
+)
+
+const (
+	JPEG    = "image/jpeg"
+	PNG     = "image/png"
+	GIF     = "image/gif"
+	WEBP    = "image/webp"
+	AVIF    = "image/avif"
+	HEIC    = "image/heic"
+	HEIF    = "image/heif"
+	JXL     = "image/jxl"
+	TIFF    = "image/tiff"
+	BMP     = "image/bmp"
+	SVG     = "image/svg+xml"
+	Unknown = "application/octet-stream"
+)
+
+var (
+	jpegSignature = []byte("\xff\xd8\xff")
+	pngSignature  = []byte("\x89PNG\r\n\x1a\n")
+	gif87a        = []byte("GIF87a")
+	gif89a        = []byte("GIF89a")
+	// JPEG XL is either a bare codestream or an ISO BMFF container
+	jxlCodestream = []byte("\xff\x0a")
+	jxlContainer  = []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a")
+	tiffLE        = []byte("II\x2a\x00")
+	tiffBE        = []byte("MM\x00\x2a")
+	bmpSignature  = []byte("BM")
+	utf8BOM       = []byte("\xef\xbb\xbf")
+)
+
+// ISO BMFF brands of the HEIF family, AVIF is checked first because its
+// files usually list the generic HEIF brands too
+var (
+	avifBrands = []string{"avif", "avis"}
+	heicBrands = []string{"heic", "heix", "heim", "heis", "hevc", "hevx", "hevm", "hevs"}
+	heifBrands = []string{"mif1", "msf1", "mif2"}
+)
+
+// Detect returns the MIME type of the image from its signature, Unknown when
+// it isn't an image format this package knows
+func Detect(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, jpegSignature):
+		return JPEG
+	case bytes.HasPrefix(data, pngSignature):
+		return PNG
+	case bytes.HasPrefix(data, gif87a), bytes.HasPrefix(data, gif89a):
+		return GIF
+	case len(data) >= 16 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return WEBP
+	case bytes.HasPrefix(data, jxlCodestream), bytes.HasPrefix(data, jxlContainer):
+		return JXL
+	case bytes.HasPrefix(data, tiffLE), bytes.HasPrefix(data, tiffBE):
+		return TIFF
+	case bytes.HasPrefix(data, bmpSignature) && bmpHeaderSize(data) > 0:
+		return BMP
+	}
+	if brands := ftypBrands(data); brands != nil {
+		switch {
+		case hasBrand(brands, avifBrands):
+			return AVIF
+		case hasBrand(brands, heicBrands):
+			return HEIC
+		case hasBrand(brands, heifBrands):
+			return HEIF
+		}
+		return Unknown
+	}
+	if isSVG(data) {
+		return SVG
+	}
+	return Unknown
+}
+
+// bmpHeaderSize returns the size of the DIB header following the BMP file
+// header, 0 when it isn't one of the known versions. The two bytes signature
+// alone would match any text starting with BM.
+func bmpHeaderSize(data []byte) int {
+	if len(data) < 18 {
+		return 0
+	}
+	switch size := int(binary.LittleEndian.Uint32(data[14:])); size {
+	case 12, 40, 52, 56, 64, 108, 124:
+		return size
+	}
+	return 0
+}
+
+// ftypBrands returns the major and compatible brands of an ISO BMFF file
+func ftypBrands(data []byte) []string {
+	if len(data) < 16 || string(data[4:8]) != "ftyp" {
+		return nil
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if size < 16 || size > len(data) {
+		return nil
+	}
+	// The minor version at 12:16 is not a brand
+	brands := []string{string(data[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(data[i:i+4]))
+	}
+	return brands
+}
+
+func hasBrand(brands, family []string) bool {
+	return slices.ContainsFunc(brands, func(brand string) bool {
+		return slices.Contains(family, brand)
+	})
+}
+
+// isSVG reports if the root element of the XML document is svg, skipping the
+// XML prologue, comments and doctype
+func isSVG(data []byte) bool {
+	root, err := svgRoot(data)
+	return err == nil && root != nil
+}
+
+// svgRoot returns the root element if it is an svg element
+func svgRoot(data []byte) (*xml.StartElement, error) {
+	data = bytes.TrimLeft(bytes.TrimPrefix(data, utf8BOM), " \t\r\n")
+	if len(data) == 0 || data[0] != '<' {
+		return nil, nil
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	// Only the root element name matters, the encoding is irrelevant for it
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "svg" {
+				return nil, nil
+			}
+			return &t, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package imageformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeGIF(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, image.NewGray(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// webp builds the RIFF header and the first chunk of a WebP file
+func webp(chunk string, payload ...byte) []byte {
+	data := []byte("RIFF\x00\x00\x00\x00WEBP" + chunk)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(payload)))
+	return append(data, payload...)
+}
+
+// isobmff builds an ftyp box with the brands followed by an ispe property
+func isobmff(brands []string, width, height uint32) []byte {
+	data := binary.BigEndian.AppendUint32(nil, uint32(16+4*(len(brands)-1)))
+	data = append(data, "ftyp"+brands[0]+"\x00\x00\x00\x00"...)
+	for _, brand := range brands[1:] {
+		data = append(data, brand...)
+	}
+	data = append(data, "\x00\x00\x00\x14ispe\x00\x00\x00\x00"...)
+	data = binary.BigEndian.AppendUint32(data, width)
+	return binary.BigEndian.AppendUint32(data, height)
+}
+
+// tiff builds a little endian TIFF header with a SHORT width and a LONG height
+func tiff(width uint16, height uint32) []byte {
+	data := []byte("II\x2a\x00\x08\x00\x00\x00\x02\x00")
+	data = binary.LittleEndian.AppendUint16(data, 256)
+	data = binary.LittleEndian.AppendUint16(data, 3)
+	data = binary.LittleEndian.AppendUint32(data, 1)
+	data = binary.LittleEndian.AppendUint16(data, width)
+	data = append(data, 0, 0)
+	data = binary.LittleEndian.AppendUint16(data, 257)
+	data = binary.LittleEndian.AppendUint16(data, 4)
+	data = binary.LittleEndian.AppendUint32(data, 1)
+	return binary.LittleEndian.AppendUint32(data, height)
+}
+
+// bmp builds the file header and a BITMAPINFOHEADER, negative heights are top-down bitmaps
+func bmp(width, height int32) []byte {
+	data := []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00")
+	data = binary.LittleEndian.AppendUint32(data, 40)
+	data = binary.LittleEndian.AppendUint32(data, uint32(width))
+	data = binary.LittleEndian.AppendUint32(data, uint32(height))
+	return append(data, make([]byte, 28)...)
+}
+
+// bmpCore builds the file header and an OS/2 BITMAPCOREHEADER
+func bmpCore(width, height uint16) []byte {
+	data := []byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x1a\x00\x00\x00")
+	data = binary.LittleEndian.AppendUint32(data, 12)
+	data = binary.LittleEndian.AppendUint16(data, width)
+	data = binary.LittleEndian.AppendUint16(data, height)
+	return append(data, 1, 0, 24, 0)
+}
+
+// bitWriter writes the JPEG XL size header, least significant bit first
+type bitWriter struct {
+	data []byte
+	pos  int
+}
+
+func (w *bitWriter) write(n int, v uint32) *bitWriter {
+	for i := 0; i < n; i++ {
+		if w.pos%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		w.data[w.pos/8] |= byte(v>>i&1) << (w.pos % 8)
+		w.pos++
+	}
+	return w
+}
+
+func jxl(w *bitWriter) []byte {
+	return append([]byte("\xff\x0a"), append(w.data, 0, 0, 0, 0)...)
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"jpeg", encodeJPEG(t, 4, 4), JPEG},
+		{"png", encodePNG(t, 4, 4), PNG},
+		{"gif", encodeGIF(t, 4, 4), GIF},
+		{"webp", webp("VP8X", make([]byte, 10)...), WEBP},
+		{"riff not webp", []byte("RIFF\x00\x00\x00\x00WAVEfmt "), Unknown},
+		{"avif", isobmff([]string{"avif", "mif1", "miaf"}, 1, 1), AVIF},
+		{"avif listed after heif brands", isobmff([]string{"mif1", "avif"}, 1, 1), AVIF},
+		{"heic", isobmff([]string{"heic", "mif1"}, 1, 1), HEIC},
+		{"heif", isobmff([]string{"mif1"}, 1, 1), HEIF},
+		{"mp4", isobmff([]string{"isom", "mp41"}, 1, 1), Unknown},
+		{"jxl codestream", []byte("\xff\x0a\x4f\x00"), JXL},
+		{"jxl container", []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"), JXL},
+		{"tiff little endian", tiff(1, 1), TIFF},
+		{"tiff big endian", []byte("MM\x00\x2a\x00\x00\x00\x08"), TIFF},
+		{"bmp", bmp(1, 1), BMP},
+		{"bmp core header", bmpCore(1, 1), BMP},
+		{"text starting with BM", []byte("BMW is a car maker, not an image format"), Unknown},
+		{"ico is out of scope", []byte("\x00\x00\x01\x00" + string(make([]byte, 30))), Unknown},
+		{"svg", []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), SVG},
+		{"svg with prologue", []byte("\xef\xbb\xbf\n<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<!-- comment -->\n<!DOCTYPE svg>\n<svg></svg>"), SVG},
+		{"html", []byte("<html><svg></svg></html>"), Unknown},
+		{"svg prefixed name", []byte("<svgx></svgx>"), Unknown},
+		{"text before svg", []byte("text<svg></svg>"), Unknown},
+		{"empty", nil, Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Detect(tt.data); got != tt.want {
+				t.Errorf("Detect() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbe(t *testing.T) {
+	vp8 := make([]byte, 10)
+	vp8[3], vp8[4], vp8[5] = 0x9d, 0x01, 0x2a
+	binary.LittleEndian.PutUint16(vp8[6:], 300)
+	binary.LittleEndian.PutUint16(vp8[8:], 200)
+	vp8l := []byte{0x2f, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(vp8l[1:], 299|199<<14)
+	vp8x := make([]byte, 10)
+	vp8x[4], vp8x[5], vp8x[6] = 0x2b, 0x01, 0x00
+	vp8x[7], vp8x[8], vp8x[9] = 0xc7, 0x00, 0x00
+
+	tests := []struct {
+		name          string
+		data          []byte
+		format        string
+		width, height int
+	}{
+		{"jpeg", encodeJPEG(t, 33, 17), JPEG, 33, 17},
+		{"png", encodePNG(t, 33, 17), PNG, 33, 17},
+		{"gif", encodeGIF(t, 33, 17), GIF, 33, 17},
+		{"webp lossy", webp("VP8 ", vp8...), WEBP, 300, 200},
+		{"webp lossless", webp("VP8L", vp8l...), WEBP, 300, 200},
+		{"webp extended", webp("VP8X", vp8x...), WEBP, 300, 200},
+		{"avif", isobmff([]string{"avif", "mif1"}, 640, 480), AVIF, 640, 480},
+		{"heic", isobmff([]string{"heic"}, 4032, 3024), HEIC, 4032, 3024},
+		{"tiff", tiff(120, 80), TIFF, 120, 80},
+		{"bmp", bmp(120, 80), BMP, 120, 80},
+		{"bmp top-down", bmp(120, -80), BMP, 120, 80},
+		{"bmp core header", bmpCore(120, 80), BMP, 120, 80},
+		{"jxl small", jxl(new(bitWriter).write(1, 1).write(5, 7).write(3, 1)), JXL, 64, 64},
+		{"jxl small 16:9", jxl(new(bitWriter).write(1, 1).write(5, 8).write(3, 5)), JXL, 128, 72},
+		{"jxl large", jxl(new(bitWriter).write(1, 0).write(2, 1).write(13, 1079).write(3, 0).write(2, 1).write(13, 1919)), JXL, 1920, 1080},
+		{"jxl container", append([]byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a\x00\x00\x00\x00jxlc"), jxl(new(bitWriter).write(1, 1).write(5, 7).write(3, 1))...), JXL, 64, 64},
+		{"svg", []byte(`<svg width="100" height="50"/>`), SVG, 100, 50},
+		{"svg px", []byte(`<svg width="100px" height="50.4px"/>`), SVG, 100, 50},
+		{"svg viewBox", []byte(`<svg viewBox="0 0 20 10"/>`), SVG, 20, 10},
+		{"svg relative width", []byte(`<svg width="100%" viewBox="0,0,20,10"/>`), SVG, 20, 10},
+		{"svg width only", []byte(`<svg width="40" viewBox="0 0 20 10"/>`), SVG, 40, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Probe(tt.data)
+			if err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if info.Format != tt.format || info.Width != tt.width || info.Height != tt.height {
+				t.Errorf("Probe() = %s %dx%d, want %s %dx%d", info.Format, info.Width, info.Height, tt.format, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestProbeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{"unknown", []byte("hello"), ErrUnknownFormat},
+		{"truncated png", []byte("\x89PNG\r\n\x1a\n\x00\x00"), ErrInvalidHeader},
+		{"truncated jpeg", encodeJPEG(t, 8, 8)[:20], ErrInvalidHeader},
+		{"truncated jxl", []byte("\xff\x0a"), ErrInvalidHeader},
+		{"tiff bad offset", []byte("II\x2a\x00\xff\x00\x00\x00"), ErrInvalidHeader},
+		{"truncated bmp", bmp(120, 80)[:24], ErrInvalidHeader},
+		{"bmp negative width", bmp(-120, 80), ErrInvalidHeader},
+		{"svg without size", []byte(`<svg/>`), ErrInvalidHeader},
+		{"svg relative size", []byte(`<svg width="50%" height="2em"/>`), ErrInvalidHeader},
+		{"heif without ispe", []byte("\x00\x00\x00\x10ftypmif1\x00\x00\x00\x00"), ErrInvalidHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Probe(tt.data); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Probe() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
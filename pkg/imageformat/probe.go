@@ -0,0 +1,347 @@
+package imageformat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown image format")
+	ErrInvalidHeader = errors.New("invalid or truncated image header")
+)
+
+// Info is what can be read from the image header without decoding it
+type Info struct {
+	Format string
+	// Width and Height as stored, without applying the EXIF orientation
+	Width  int
+	Height int
+}
+
+// Probe detects the image format and reads its dimensions from the header
+func Probe(data []byte) (*Info, error) {
+	info := &Info{Format: Detect(data)}
+	var ok bool
+	switch info.Format {
+	case JPEG:
+		info.Width, info.Height, ok = jpegSize(data)
+	case PNG:
+		info.Width, info.Height, ok = pngSize(data)
+	case GIF:
+		info.Width, info.Height, ok = gifSize(data)
+	case WEBP:
+		info.Width, info.Height, ok = webpSize(data)
+	case AVIF, HEIC, HEIF:
+		info.Width, info.Height, ok = ispeSize(data)
+	case JXL:
+		info.Width, info.Height, ok = jxlSize(data)
+	case TIFF:
+		info.Width, info.Height, ok = tiffSize(data)
+	case BMP:
+		info.Width, info.Height, ok = bmpSize(data)
+	case SVG:
+		info.Width, info.Height, ok = svgSize(data)
+	default:
+		return nil, ErrUnknownFormat
+	}
+	if !ok {
+		return nil, ErrInvalidHeader
+	}
+	return info, nil
+}
+
+func pngSize(data []byte) (int, int, bool) {
+	if len(data) < 24 || string(data[12:16]) != "IHDR" {
+		return 0, 0, false
+	}
+	return int(binary.BigEndian.Uint32(data[16:])), int(binary.BigEndian.Uint32(data[20:])), true
+}
+
+func gifSize(data []byte) (int, int, bool) {
+	if len(data) < 10 {
+		return 0, 0, false
+	}
+	return int(binary.LittleEndian.Uint16(data[6:])), int(binary.LittleEndian.Uint16(data[8:])), true
+}
+
+// jpegSize walks the segments up to the start of frame
+func jpegSize(data []byte) (int, int, bool) {
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return 0, 0, false
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte
+			i++
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd9:
+			// Markers without a segment
+			i += 2
+			continue
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		// SOF0 to SOF15, except DHT, JPG and DAC
+		if marker >= 0xc0 && marker <= 0xcf && marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+			if i+9 > len(data) {
+				return 0, 0, false
+			}
+			return int(binary.BigEndian.Uint16(data[i+7:])), int(binary.BigEndian.Uint16(data[i+5:])), true
+		}
+		i += 2 + length
+	}
+	return 0, 0, false
+}
+
+func webpSize(data []byte) (int, int, bool) {
+	switch string(data[12:16]) {
+	case "VP8 ":
+		if len(data) < 30 {
+			return 0, 0, false
+		}
+		return int(binary.LittleEndian.Uint16(data[26:]) & 0x3fff), int(binary.LittleEndian.Uint16(data[28:]) & 0x3fff), true
+	case "VP8L":
+		if len(data) < 25 {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(data[21:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, true
+	case "VP8X":
+		if len(data) < 30 {
+			return 0, 0, false
+		}
+		return int(uint24(data[24:])) + 1, int(uint24(data[27:])) + 1, true
+	}
+	return 0, 0, false
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// ispeSize returns the biggest image spatial extents property of a HEIF file,
+// grid images also have an ispe for each tile
+func ispeSize(data []byte) (int, int, bool) {
+	var width, height int
+	for i := 0; ; {
+		j := bytes.Index(data[i:], []byte("ispe"))
+		if j < 0 {
+			break
+		}
+		i += j + 4
+		// Version and flags, then the width and height
+		if i+12 > len(data) {
+			break
+		}
+		w, h := int(binary.BigEndian.Uint32(data[i+4:])), int(binary.BigEndian.Uint32(data[i+8:]))
+		if w*h > width*height {
+			width, height = w, h
+		}
+	}
+	return width, height, width > 0 && height > 0
+}
+
+func tiffSize(data []byte) (int, int, bool) {
+	if len(data) < 8 {
+		return 0, 0, false
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[0] == 'M' {
+		order = binary.BigEndian
+	}
+	ifd := int(order.Uint32(data[4:]))
+	if ifd+2 > len(data) || ifd < 8 {
+		return 0, 0, false
+	}
+	entries := int(order.Uint16(data[ifd:]))
+	var width, height int
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(data) {
+			return 0, 0, false
+		}
+		tag, kind := order.Uint16(data[entry:]), order.Uint16(data[entry+2:])
+		var value int
+		switch kind {
+		case 3: // SHORT
+			value = int(order.Uint16(data[entry+8:]))
+		case 4: // LONG
+			value = int(order.Uint32(data[entry+8:]))
+		default:
+			continue
+		}
+		switch tag {
+		case 256:
+			width = value
+		case 257:
+			height = value
+		}
+	}
+	return width, height, width > 0 && height > 0
+}
+
+func bmpSize(data []byte) (int, int, bool) {
+	headerSize := bmpHeaderSize(data)
+	if len(data) < 14+headerSize {
+		return 0, 0, false
+	}
+	if headerSize == 12 {
+		// OS/2 core header with unsigned 16 bits dimensions
+		width, height := int(binary.LittleEndian.Uint16(data[18:])), int(binary.LittleEndian.Uint16(data[20:]))
+		return width, height, width > 0 && height > 0
+	}
+	width := int64(int32(binary.LittleEndian.Uint32(data[18:])))
+	// Negative heights are top-down bitmaps
+	height := int64(int32(binary.LittleEndian.Uint32(data[22:])))
+	if height < 0 {
+		height = -height
+	}
+	return int(width), int(height), width > 0 && height > 0
+}
+
+// jxlRatios are the fixed aspect ratios of the JPEG XL size header
+var jxlRatios = [8][2]uint64{{}, {1, 1}, {12, 10}, {4, 3}, {3, 2}, {16, 9}, {5, 4}, {2, 1}}
+
+// jxlSize parses the SizeHeader at the start of the codestream
+func jxlSize(data []byte) (int, int, bool) {
+	codestream := data
+	if bytes.HasPrefix(data, jxlContainer) {
+		codestream = jxlContainerCodestream(data)
+	}
+	if !bytes.HasPrefix(codestream, jxlCodestream) {
+		return 0, 0, false
+	}
+	r := &bitReader{data: codestream[2:]}
+	small := r.read(1) == 1
+	dimension := func() uint64 {
+		if small {
+			return (uint64(r.read(5)) + 1) * 8
+		}
+		bits := [4]int{9, 13, 18, 30}[r.read(2)]
+		return uint64(r.read(bits)) + 1
+	}
+	height := dimension()
+	ratio := r.read(3)
+	var width uint64
+	if ratio == 0 {
+		width = dimension()
+	} else {
+		width = height * jxlRatios[ratio][0] / jxlRatios[ratio][1]
+	}
+	if r.overflow || width > math.MaxInt32 || height > math.MaxInt32 {
+		return 0, 0, false
+	}
+	return int(width), int(height), true
+}
+
+// jxlContainerCodestream returns the start of the codestream stored in the
+// jxlc box, or in the first jxlp box for partial codestreams
+func jxlContainerCodestream(data []byte) []byte {
+	for i := 0; i+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[i:]))
+		boxType := string(data[i+4 : i+8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data) - i)
+		case 1:
+			if i+16 > len(data) {
+				return nil
+			}
+			size = binary.BigEndian.Uint64(data[i+8:])
+			header = 16
+		}
+		if size < header {
+			return nil
+		}
+		switch boxType {
+		case "jxlc":
+			return data[i+int(header):]
+		case "jxlp":
+			// Skips the part index
+			if i+int(header)+4 > len(data) {
+				return nil
+			}
+			return data[i+int(header)+4:]
+		}
+		if size > uint64(len(data)-i) {
+			return nil
+		}
+		i += int(size)
+	}
+	return nil
+}
+
+// bitReader reads the bits of a JPEG XL codestream, least significant first
+type bitReader struct {
+	data     []byte
+	pos      int
+	overflow bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos/8 >= len(r.data) {
+			r.overflow = true
+			return 0
+		}
+		v |= uint32(r.data[r.pos/8]>>(r.pos%8)&1) << i
+		r.pos++
+	}
+	return v
+}
+
+// svgSize reads the width and height attributes of the root element, the
+// viewBox is used when they are missing or relative
+func svgSize(data []byte) (int, int, bool) {
+	root, err := svgRoot(data)
+	if err != nil || root == nil {
+		return 0, 0, false
+	}
+	var width, height, viewBoxWidth, viewBoxHeight float64
+	for _, attr := range root.Attr {
+		switch attr.Name.Local {
+		case "width":
+			width = svgLength(attr.Value)
+		case "height":
+			height = svgLength(attr.Value)
+		case "viewBox":
+			fields := strings.FieldsFunc(attr.Value, func(r rune) bool {
+				return r == ' ' || r == ',' || r == '\t' || r == '\n' || r == '\r'
+			})
+			if len(fields) == 4 {
+				viewBoxWidth = svgLength(fields[2])
+				viewBoxHeight = svgLength(fields[3])
+			}
+		}
+	}
+	if viewBoxWidth > 0 && viewBoxHeight > 0 {
+		switch {
+		case width == 0 && height == 0:
+			width, height = viewBoxWidth, viewBoxHeight
+		case width == 0:
+			width = height * viewBoxWidth / viewBoxHeight
+		case height == 0:
+			height = width * viewBoxHeight / viewBoxWidth
+		}
+	}
+	w, h := int(math.Round(width)), int(math.Round(height))
+	return w, h, w > 0 && h > 0
+}
+
+// svgLength parses an absolute length in pixels, relative units return 0
+func svgLength(v string) float64 {
+	v = strings.TrimSuffix(strings.TrimSpace(v), "px")
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"github.com/patrickn2/go-image-optimizer/pkg/coalesce"
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "gopizer"
+
+var (
+	// RequestsTotal counts image responses by status code, content type and X-Cache value
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Image requests by status code, output format and cache result",
+	}, []string{"status", "format", "cache"})
+
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Image request duration by status code",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"status"})
+
+	// CacheLookupsTotal counts cache lookups by backend and result (hit, miss or error)
+	CacheLookupsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cache_lookups_total",
+		Help:      "Cache lookups by backend and result",
+	}, []string{"backend", "result"})
+
+	CacheOperationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cache_operation_duration_seconds",
+		Help:      "Cache get and set duration by backend",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"backend", "operation"})
+
+	OriginFetchDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "origin_fetch_duration_seconds",
+		Help:      "Origin image download duration by result",
+		Buckets:   []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"result"})
+
+	TransformDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "transform_duration_seconds",
+		Help:      "libvips resize and encode duration by output format",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"format"})
+
+	TransformsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "transforms_in_flight",
+		Help:      "Images being transformed right now, including the ones waiting in the processing queue",
+	})
+
+	SourceBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "source_bytes_total",
+		Help:      "Bytes of the source images transformed",
+	})
+
+	OutputBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "output_bytes_total",
+		Help:      "Bytes of the transformed images",
+	})
+)
+
+// RegisterCoalescing exposes how many cache misses were processed and how
+// many waited for an identical request already in progress
+func RegisterCoalescing(stats func() coalesce.Stats) {
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "processed_requests_total",
+		Help:      "Cache misses and revalidations that downloaded and transformed the image",
+	}, func() float64 { return float64(stats().Executed) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "coalesced_requests_total",
+		Help:      "Cache misses that waited for an identical request in progress instead of transforming again",
+	}, func() float64 { return float64(stats().Coalesced) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "processing_requests_in_flight",
+		Help:      "Distinct images being downloaded and transformed right now",
+	}, func() float64 { return float64(stats().InFlight) })
+}
+
+// RegisterInMemoryCache exposes the in-memory cache size and eviction stats
+func RegisterInMemoryCache(db *database.PkgDatabaseInMemory) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inmemory_cache_entries",
+		Help:      "Entries stored in the in-memory cache",
+	}, func() float64 { return float64(db.Stats().Entries) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inmemory_cache_bytes",
+		Help:      "Bytes stored in the in-memory cache",
+	}, func() float64 { return float64(db.Stats().Bytes) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "inmemory_cache_evictions_total",
+		Help:      "Entries evicted from the in-memory cache to stay under CACHE_MAX_BYTES",
+	}, func() float64 { return float64(db.Stats().Evictions) })
+	promauto.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "inmemory_cache_expirations_total",
+		Help:      "Entries removed from the in-memory cache after CACHE_EXPIRATION",
+	}, func() float64 { return float64(db.Stats().Expirations) })
+}
@@ -0,0 +1,142 @@
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrAddressNotAllowed = errors.New("address not allowed")
+	ErrTooManyRedirects  = errors.New("too many redirects")
+	ErrInvalidScheme     = errors.New("invalid redirect scheme")
+)
+
+// deniedPrefixes are the special purpose ranges not covered by the netip
+// helpers, they are internal, shared or translate to other address spaces
+var deniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // "this" network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("224.0.0.0/4"),    // multicast
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, reaches the IPv4 space
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4, reaches the IPv4 space
+	netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+type Options struct {
+	// AllowCIDRs are always allowed, even if they are private or denied
+	AllowCIDRs []netip.Prefix
+	// DenyCIDRs are refused on top of the loopback, link-local and private ranges
+	DenyCIDRs    []netip.Prefix
+	MaxRedirects int
+}
+
+// NewClient returns an http client that refuses to connect to internal
+// addresses. The check runs on the resolved IP of every connection, so it
+// can't be bypassed with DNS names pointing to internal hosts or redirects.
+func NewClient(o Options) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			return o.checkAddress(address)
+		},
+	}
+	transport := &http.Transport{
+		// Proxy is disabled on purpose, otherwise only the proxy address would be checked
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: o.CheckRedirect,
+	}
+}
+
+// CheckRedirect caps the number of redirects and only allows http(s) targets
+func (o Options) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > o.MaxRedirects {
+		return ErrTooManyRedirects
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return ErrInvalidScheme
+	}
+	return nil
+}
+
+func (o Options) checkAddress(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := addrPort.Addr().Unmap()
+	if !o.IsAllowed(ip) {
+		return fmt.Errorf("%w: %s", ErrAddressNotAllowed, ip)
+	}
+	return nil
+}
+
+// IsAllowed reports if the client is allowed to connect to the ip
+func (o Options) IsAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, p := range o.AllowCIDRs {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	for _, p := range o.DenyCIDRs {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	for _, p := range deniedPrefixes {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	// IsPrivate covers RFC1918 and IPv6 unique local addresses (fc00::/7)
+	if !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	return true
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs, single IPs are accepted too
+func ParseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip, err := netip.ParseAddr(c)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,138 @@
+package safehttp
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+)
+
+func TestIsAllowed(t *testing.T) {
+	o := Options{
+		AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")},
+		DenyCIDRs:  []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+	}
+	tests := []struct {
+		ip      string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::a00:1", false},
+		{"2002:a00:1::1", false},
+		{"ff02::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"::ffff:93.184.216.34", true},
+		// The allow list wins over the private ranges
+		{"10.1.2.3", true},
+		{"::ffff:10.1.2.3", true},
+		{"203.0.113.10", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := o.IsAllowed(netip.MustParseAddr(tt.ip)); got != tt.allowed {
+				t.Errorf("IsAllowed(%s) = %v, want %v", tt.ip, got, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckAddress(t *testing.T) {
+	o := Options{}
+	tests := []struct {
+		address string
+		wantErr error
+	}{
+		{"93.184.216.34:443", nil},
+		{"127.0.0.1:80", ErrAddressNotAllowed},
+		{"[::ffff:127.0.0.1]:80", ErrAddressNotAllowed},
+		{"[64:ff9b::7f00:1]:80", ErrAddressNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			if err := o.checkAddress(tt.address); !errors.Is(err, tt.wantErr) {
+				t.Errorf("checkAddress(%s) = %v, want %v", tt.address, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	o := Options{MaxRedirects: 2}
+	tests := []struct {
+		name    string
+		target  string
+		via     int
+		wantErr error
+	}{
+		{"http", "http://example.com/a.png", 1, nil},
+		{"https", "https://example.com/a.png", 2, nil},
+		{"too many", "https://example.com/a.png", 3, ErrTooManyRedirects},
+		{"file scheme", "file:///etc/passwd", 1, ErrInvalidScheme},
+		{"gopher scheme", "gopher://example.com", 1, ErrInvalidScheme},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			via := make([]*http.Request, tt.via)
+			if err := o.CheckRedirect(&http.Request{URL: target}, via); !errors.Is(err, tt.wantErr) {
+				t.Errorf("CheckRedirect() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, false},
+		{" 10.1.2.3/8 , 192.168.0.1 ", []string{"10.0.0.0/8", "192.168.0.1/32"}, false},
+		{"::1,fd00::/8", []string{"::1/128", "fd00::/8"}, false},
+		{"::ffff:10.0.0.1", []string{"10.0.0.1/32"}, false},
+		{"10.0.0.0/33", nil, true},
+		{"not-an-ip", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseCIDRs(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCIDRs(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ParseCIDRs(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+			for i, p := range got {
+				if p.String() != tt.want[i] {
+					t.Errorf("ParseCIDRs(%q)[%d] = %s, want %s", tt.in, i, p, tt.want[i])
+				}
+			}
+		})
+	}
+}
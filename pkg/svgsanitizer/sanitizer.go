@@ -0,0 +1,376 @@
+package svgsanitizer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var ErrInvalidSVG = errors.New("invalid svg")
+
+// Elements of any other namespace, like XHTML, are removed. Documents without
+// namespace declarations are accepted, their elements are inert.
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+// Elements removed with all their content, they run scripts or embed other documents
+var forbiddenElements = []string{"script", "foreignobject", "iframe", "embed", "object", "audio", "video", "handler", "listener"}
+
+// Animations can rewrite links to javascript: URLs
+var animationElements = []string{"set", "animate", "animatemotion", "animatetransform"}
+
+// Elements whose whitespace is content
+var textElements = []string{"text", "tspan", "textpath", "style", "title", "desc"}
+
+// Editor data removed by the minification
+var (
+	editorElements   = []string{"metadata"}
+	editorNamespaces = []string{"sodipodi", "inkscape", "sketch", "serif"}
+)
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+)
+
+var (
+	// Only local fragments and inline raster images can be referenced
+	safeHref = regexp.MustCompile(`^(#|data:image/(png|jpeg|gif|webp)[;,])`)
+	// CSS references to anything but local fragments, matched once the CSS
+	// escapes are resolved
+	externalCSS = regexp.MustCompile(`(?i)(@import|expression\s*\(|(url|image-set)\s*\(\s*['"]?\s*[^#'"\s])`)
+	scriptURL   = regexp.MustCompile(`(?i)(java|vb)script:`)
+)
+
+// Sanitize removes from the SVG the scripts, event handlers, embedded
+// documents, elements of other namespaces and external references, and drops
+// the doctype so no entity can be declared. With minify comments, editor data
+// and the whitespace between elements are removed too.
+func Sanitize(data []byte, minify bool) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = true
+	decoder.Entity = xml.HTMLEntity
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "us-ascii") {
+			return nil, fmt.Errorf("unsupported charset %s", charset)
+		}
+		return input, nil
+	}
+	s := &sanitizer{decoder: decoder, minify: minify}
+	if err := s.run(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSVG, err)
+	}
+	if !s.root {
+		return nil, fmt.Errorf("%w: no svg root element", ErrInvalidSVG)
+	}
+	return s.out.Bytes(), nil
+}
+
+type element struct {
+	name xml.Name
+	// namespaces declared by the element by prefix, "" is the default namespace
+	namespaces map[string]string
+}
+
+type sanitizer struct {
+	decoder *xml.Decoder
+	minify  bool
+	out     bytes.Buffer
+	// open elements, to match the end tags, resolve the namespaces and keep
+	// the whitespace inside text elements
+	stack []element
+	root  bool
+	// start tag written without its closing >, so empty elements can be self closed
+	pending bool
+}
+
+func (s *sanitizer) run() error {
+	for {
+		token, err := s.decoder.RawToken()
+		if err == io.EOF {
+			if len(s.stack) > 0 {
+				return fmt.Errorf("unclosed element %s", qualifiedName(s.stack[len(s.stack)-1].name))
+			}
+			s.flush()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if err := s.start(t); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			if err := s.end(t); err != nil {
+				return err
+			}
+		case xml.CharData:
+			s.text(t)
+		case xml.Comment:
+			if !s.minify && !bytes.Contains(t, []byte("--")) {
+				s.flush()
+				s.out.WriteString("<!--")
+				s.out.Write(t)
+				s.out.WriteString("-->")
+			}
+		case xml.ProcInst:
+			// Only the XML declaration, xml-stylesheet loads external documents
+			if t.Target == "xml" && s.out.Len() == 0 && !s.minify {
+				s.out.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+			}
+		case xml.Directive:
+			// Doctypes are dropped with their entity declarations
+		}
+	}
+}
+
+func (s *sanitizer) start(t xml.StartElement) error {
+	name := strings.ToLower(t.Name.Local)
+	namespaces := declaredNamespaces(t)
+	namespace, bound := s.namespace(t.Name.Space, namespaces)
+	inSVG := bound && (namespace == "" || namespace == svgNamespace)
+	if len(s.stack) == 0 {
+		if s.root || name != "svg" || !inSVG {
+			return fmt.Errorf("unexpected root element %s", qualifiedName(t.Name))
+		}
+		s.root = true
+	}
+	if !inSVG || slices.Contains(forbiddenElements, name) ||
+		slices.Contains(animationElements, name) && animatesLink(t) ||
+		s.minify && (slices.Contains(editorElements, name) || slices.Contains(editorNamespaces, t.Name.Space)) {
+		return s.skip(t)
+	}
+	if name == "style" {
+		return s.style(t, namespaces)
+	}
+	s.writeStart(t, namespaces)
+	return nil
+}
+
+func (s *sanitizer) writeStart(t xml.StartElement, namespaces map[string]string) {
+	s.flush()
+	s.stack = append(s.stack, element{name: t.Name, namespaces: namespaces})
+	s.out.WriteByte('<')
+	s.out.WriteString(qualifiedName(t.Name))
+	for _, attr := range t.Attr {
+		if !s.safeAttr(attr) {
+			continue
+		}
+		s.out.WriteByte(' ')
+		s.out.WriteString(qualifiedName(attr.Name))
+		s.out.WriteString(`="`)
+		attrEscaper.WriteString(&s.out, attr.Value)
+		s.out.WriteByte('"')
+	}
+	s.pending = true
+}
+
+func (s *sanitizer) end(t xml.EndElement) error {
+	// RawToken doesn't check that the end tags match the open elements
+	if len(s.stack) == 0 || s.stack[len(s.stack)-1].name != t.Name {
+		return fmt.Errorf("unexpected end element %s", qualifiedName(t.Name))
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+	if s.pending {
+		s.out.WriteString("/>")
+		s.pending = false
+		return nil
+	}
+	s.out.WriteString("</")
+	s.out.WriteString(qualifiedName(t.Name))
+	s.out.WriteByte('>')
+	return nil
+}
+
+func (s *sanitizer) text(t xml.CharData) {
+	if len(s.stack) == 0 {
+		// Only whitespace is allowed around the root element
+		return
+	}
+	if s.minify && len(bytes.TrimSpace(t)) == 0 && !slices.Contains(textElements, strings.ToLower(s.stack[len(s.stack)-1].name.Local)) {
+		return
+	}
+	s.flush()
+	textEscaper.WriteString(&s.out, string(t))
+}
+
+// style keeps the style element only if its CSS has no external references
+func (s *sanitizer) style(t xml.StartElement, namespaces map[string]string) error {
+	var css bytes.Buffer
+	for {
+		token, err := s.decoder.RawToken()
+		if err != nil {
+			return err
+		}
+		switch c := token.(type) {
+		case xml.CharData:
+			css.Write(c)
+		case xml.StartElement:
+			return fmt.Errorf("unexpected element %s in style", c.Name.Local)
+		case xml.EndElement:
+			if c.Name != t.Name {
+				return fmt.Errorf("unexpected end element %s in style", qualifiedName(c.Name))
+			}
+			if unescaped := unescapeCSS(css.String()); externalCSS.MatchString(unescaped) || scriptURL.MatchString(unescaped) {
+				return nil
+			}
+			s.writeStart(t, namespaces)
+			s.flush()
+			textEscaper.WriteString(&s.out, css.String())
+			return s.end(c)
+		}
+	}
+}
+
+// skip discards the element that was just opened with all its content
+func (s *sanitizer) skip(t xml.StartElement) error {
+	stack := []xml.Name{t.Name}
+	for len(stack) > 0 {
+		token, err := s.decoder.RawToken()
+		if err != nil {
+			return err
+		}
+		switch c := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, c.Name)
+		case xml.EndElement:
+			if stack[len(stack)-1] != c.Name {
+				return fmt.Errorf("unexpected end element %s", qualifiedName(c.Name))
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	return nil
+}
+
+func (s *sanitizer) safeAttr(attr xml.Attr) bool {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.ToLower(strings.Join(strings.Fields(attr.Value), ""))
+	switch {
+	case strings.HasPrefix(name, "on"):
+		return false
+	case name == "href", attr.Name.Space == "xml" && name == "base",
+		name == "src", name == "action", name == "formaction":
+		return safeHref.MatchString(value)
+	case s.minify && slices.Contains(editorNamespaces, attr.Name.Space),
+		s.minify && attr.Name.Space == "xmlns" && slices.Contains(editorNamespaces, attr.Name.Local):
+		return false
+	}
+	// Presentation attributes and style are parsed as CSS
+	css := unescapeCSS(attr.Value)
+	return !scriptURL.MatchString(value) && !scriptURL.MatchString(css) && !externalCSS.MatchString(css)
+}
+
+// declaredNamespaces returns the namespaces declared by the xmlns attributes of the element
+func declaredNamespaces(t xml.StartElement) map[string]string {
+	var namespaces map[string]string
+	for _, attr := range t.Attr {
+		prefix, ok := "", attr.Name.Space == "" && attr.Name.Local == "xmlns"
+		if attr.Name.Space == "xmlns" {
+			prefix, ok = attr.Name.Local, true
+		}
+		if ok {
+			if namespaces == nil {
+				namespaces = make(map[string]string)
+			}
+			namespaces[prefix] = attr.Value
+		}
+	}
+	return namespaces
+}
+
+// namespace resolves the prefix of an element opened inside the current one,
+// declared holds the namespaces declared by the element itself. An unbound
+// prefix isn't resolved, no namespace is only bound for the empty prefix.
+func (s *sanitizer) namespace(prefix string, declared map[string]string) (string, bool) {
+	if namespace, ok := declared[prefix]; ok {
+		return namespace, true
+	}
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		if namespace, ok := s.stack[i].namespaces[prefix]; ok {
+			return namespace, true
+		}
+	}
+	return "", prefix == ""
+}
+
+// unescapeCSS resolves the CSS escapes the way the browsers do before
+// tokenizing, \75rl( and u\rl( are both url(
+func unescapeCSS(css string) string {
+	if !strings.Contains(css, `\`) {
+		return css
+	}
+	var b strings.Builder
+	for i := 0; i < len(css); i++ {
+		if css[i] != '\\' || i+1 == len(css) {
+			b.WriteByte(css[i])
+			continue
+		}
+		i++
+		digits := 0
+		for digits < 6 && i+digits < len(css) && isHexDigit(css[i+digits]) {
+			digits++
+		}
+		if digits == 0 {
+			// An escaped newline continues the line, any other character is itself
+			if css[i] != '\n' {
+				b.WriteByte(css[i])
+			}
+			continue
+		}
+		codePoint, _ := strconv.ParseUint(css[i:i+digits], 16, 32)
+		if codePoint == 0 || codePoint > unicode.MaxRune || codePoint >= 0xd800 && codePoint <= 0xdfff {
+			codePoint = unicode.ReplacementChar
+		}
+		b.WriteRune(rune(codePoint))
+		i += digits
+		// A whitespace after the hex digits ends the escape and is dropped
+		switch {
+		case strings.HasPrefix(css[i:], "\r\n"):
+			i++
+		case i < len(css) && strings.IndexByte(" \t\n\r\f", css[i]) >= 0:
+		default:
+			i--
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// animatesLink reports if the animation element targets a link attribute
+func animatesLink(t xml.StartElement) bool {
+	for _, attr := range t.Attr {
+		if attr.Name.Local == "attributeName" && strings.HasSuffix(strings.ToLower(attr.Value), "href") {
+			return true
+		}
+	}
+	return false
+}
+
+// flush closes the pending start tag
+func (s *sanitizer) flush() {
+	if s.pending {
+		s.out.WriteByte('>')
+		s.pending = false
+	}
+}
+
+// qualifiedName writes the name with its prefix as in the source document,
+// RawToken doesn't translate the prefixes to namespace URLs
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+	return name.Space + ":" + name.Local
+}
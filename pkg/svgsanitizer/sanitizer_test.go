@@ -0,0 +1,81 @@
+package svgsanitizer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		minify bool
+		want   string
+	}{
+		{"empty element is self closed", `<svg><g></g></svg>`, false, `<svg><g/></svg>`},
+		{"script removed", `<svg><script>alert(1)</script><rect/></svg>`, false, `<svg><rect/></svg>`},
+		{"nested forbidden content removed", `<svg><foreignObject><div><p>x</p></div></foreignObject></svg>`, false, `<svg/>`},
+		{"event handler removed", `<svg onload="alert(1)"><rect onclick="x" width="1"/></svg>`, false, `<svg><rect width="1"/></svg>`},
+		{"external href removed", `<svg><use href="https://example.com/a.svg#x"/><use xlink:href="#local"/></svg>`, false, `<svg><use/><use xlink:href="#local"/></svg>`},
+		{"javascript url removed", `<svg><a href="java&#x09;script:alert(1)"><rect/></a></svg>`, false, `<svg><a><rect/></a></svg>`},
+		{"data image kept", `<svg><image href="data:image/png;base64,AA=="/></svg>`, false, `<svg><image href="data:image/png;base64,AA=="/></svg>`},
+		{"href animation removed", `<svg><a><set attributeName="href" to="javascript:alert(1)"/></a><animate attributeName="x"/></svg>`, false, `<svg><a/><animate attributeName="x"/></svg>`},
+		{"external css removed", `<svg><style>@import url(https://example.com/a.css);</style></svg>`, false, `<svg/>`},
+		{"local css kept", `<svg><style>rect { fill: url(#g) }</style></svg>`, false, `<svg><style>rect { fill: url(#g) }</style></svg>`},
+		{"hex escaped css url removed", `<svg><style>rect{fill:\75rl(https://evil.example/x)}</style></svg>`, false, `<svg/>`},
+		{"hex escaped css import removed", `<svg><style>@\69mport "https://evil.example/a.css";</style></svg>`, false, `<svg/>`},
+		{"escaped css url removed", `<svg><style>rect{fill:u\r\l(https://evil.example/x)}</style></svg>`, false, `<svg/>`},
+		{"css image set removed", `<svg><style>rect{fill:image-set("https://evil.example/x" 1x)}</style></svg>`, false, `<svg/>`},
+		{"escaped local css kept", `<svg><style>.a\:b{fill:url(#g)}</style></svg>`, false, `<svg><style>.a\:b{fill:url(#g)}</style></svg>`},
+		{"escaped style attribute removed", `<svg><rect style="fill:u\72l(https://evil.example/x)" width="1"/></svg>`, false, `<svg><rect width="1"/></svg>`},
+		{"escaped presentation attribute removed", `<svg><rect fill="\75 rl(https://evil.example/x)"/></svg>`, false, `<svg><rect/></svg>`},
+		{"src and action removed", `<svg><image src="https://evil.example/x"/><a action="https://evil.example/" formaction="//evil.example/"/></svg>`, false, `<svg><image/><a/></svg>`},
+		{"xhtml elements removed", `<svg xmlns="http://www.w3.org/2000/svg"><g xmlns="http://www.w3.org/1999/xhtml"><img src="https://evil.example/x"/></g><rect/></svg>`, false, `<svg xmlns="http://www.w3.org/2000/svg"><rect/></svg>`},
+		{"prefixed xhtml elements removed", `<svg xmlns:h="http://www.w3.org/1999/xhtml"><h:form action="https://evil.example/"><h:input/></h:form></svg>`, false, `<svg xmlns:h="http://www.w3.org/1999/xhtml"/>`},
+		{"unbound prefix removed", `<svg><x:frame src="https://evil.example/"/></svg>`, false, `<svg/>`},
+		{"svg default namespace restored", `<svg xmlns:h="http://www.w3.org/1999/xhtml"><h:g xmlns="http://www.w3.org/1999/xhtml"/><g xmlns="http://www.w3.org/2000/svg"><rect/></g></svg>`, false, `<svg xmlns:h="http://www.w3.org/1999/xhtml"><g xmlns="http://www.w3.org/2000/svg"><rect/></g></svg>`},
+		{"doctype dropped", `<?xml version="1.0"?><!DOCTYPE svg [<!ENTITY x "y">]><svg/>`, false, `<?xml version="1.0" encoding="UTF-8"?><svg/>`},
+		{"comment kept", `<svg><!-- c --></svg>`, false, `<svg><!-- c --></svg>`},
+		{"minify", "<svg xmlns:inkscape=\"i\">\n  <metadata>x</metadata>\n  <!-- c -->\n  <g inkscape:label=\"l\">\n    <rect/>\n  </g>\n  <text> a b </text>\n</svg>", true, `<svg><g><rect/></g><text> a b </text></svg>`},
+		{"prefixed elements", `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:g></svg:g></svg:svg>`, false, `<svg:svg xmlns:svg="http://www.w3.org/2000/svg"><svg:g/></svg:svg>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Sanitize([]byte(tt.in), tt.minify)
+			if err != nil {
+				t.Fatalf("Sanitize() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Sanitize() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSanitizeInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+	}{
+		{"not svg", `<html></html>`},
+		{"xhtml root", `<svg xmlns="http://www.w3.org/1999/xhtml"><img src="https://evil.example/x"/><frame src="https://evil.example/"/><form action="https://evil.example/"><input/></form></svg>`},
+		{"unbound root prefix", `<x:svg/>`},
+		{"empty", ``},
+		{"two roots", `<svg/><svg/>`},
+		{"crossed end tags", `<svg><g></svg></g>`},
+		{"wrong end tag", `<svg><g></rect></svg>`},
+		{"end tag prefix mismatch", `<svg><a:g></b:g></svg>`},
+		{"end tag after root", `<svg></svg></g>`},
+		{"unclosed element", `<svg><g>`},
+		{"crossed end tags in skipped element", `<svg><script><g></script></g></svg>`},
+		{"wrong end tag in style", `<svg><style>a{}</g></svg>`},
+		{"unsupported charset", `<?xml version="1.0" encoding="UTF-16"?><svg/>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Sanitize([]byte(tt.in), false); !errors.Is(err, ErrInvalidSVG) {
+				t.Errorf("Sanitize() error = %v, want ErrInvalidSVG", err)
+			}
+		})
+	}
+}
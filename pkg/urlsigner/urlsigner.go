@@ -0,0 +1,129 @@
+package urlsigner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	SignatureParam = "s"
+	KeyIDParam     = "kid"
+)
+
+var (
+	ErrMissingSignature = errors.New("missing url signature")
+	ErrInvalidSignature = errors.New("invalid url signature")
+	ErrUnknownKey       = errors.New("unknown url signing key")
+)
+
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+type Signer struct {
+	keys []Key
+}
+
+// New creates a Signer. The first key is used to sign new URLs, all keys are
+// accepted when verifying so old keys can be kept around during rotation.
+func New(keys ...Key) *Signer {
+	return &Signer{
+		keys: keys,
+	}
+}
+
+// ParseKeys parses a comma separated list of keyId:secret pairs
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid signing key %q, expected keyId:secret", pair)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicated signing key id %q", id)
+		}
+		seen[id] = true
+		keys = append(keys, Key{
+			ID:     id,
+			Secret: []byte(secret),
+		})
+	}
+	return keys, nil
+}
+
+// Sign returns a copy of the query values with the key id and signature set
+func (s *Signer) Sign(values url.Values) url.Values {
+	signed := url.Values{}
+	for k, v := range values {
+		if k == SignatureParam {
+			continue
+		}
+		signed[k] = append([]string(nil), v...)
+	}
+	key := s.keys[0]
+	signed.Set(KeyIDParam, key.ID)
+	signed.Set(SignatureParam, signature(key.Secret, signed))
+	return signed
+}
+
+// SignURL signs the query string of rawUrl and returns the full signed URL
+func (s *Signer) SignURL(rawUrl string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	u.RawQuery = s.Sign(u.Query()).Encode()
+	return u.String(), nil
+}
+
+// Verify checks the signature of the query values against the key referenced
+// by the kid param. Every param other than the signature itself is signed, so
+// adding, removing or changing any of them invalidates the URL.
+func (s *Signer) Verify(values url.Values) error {
+	sig := values.Get(SignatureParam)
+	if sig == "" {
+		return ErrMissingSignature
+	}
+	kid := values.Get(KeyIDParam)
+	for _, key := range s.keys {
+		if key.ID != kid {
+			continue
+		}
+		if !hmac.Equal([]byte(sig), []byte(signature(key.Secret, values))) {
+			return ErrInvalidSignature
+		}
+		return nil
+	}
+	return ErrUnknownKey
+}
+
+func signature(secret []byte, values url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical(values)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// canonical builds the string to be signed, params are sorted by key and
+// the signature param is left out
+func canonical(values url.Values) string {
+	c := url.Values{}
+	for k, v := range values {
+		if k == SignatureParam {
+			continue
+		}
+		c[k] = v
+	}
+	return c.Encode()
+}
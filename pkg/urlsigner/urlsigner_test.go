@@ -0,0 +1,124 @@
+package urlsigner
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"k1:secret", []string{"k1"}, false},
+		{" k1:secret , k2:other:with:colons ", []string{"k1", "k2"}, false},
+		{"k1", nil, true},
+		{":secret", nil, true},
+		{"k1:", nil, true},
+		{"k1:a,k1:b", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			keys, err := ParseKeys(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseKeys(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if len(keys) != len(tt.want) {
+				t.Fatalf("ParseKeys(%q) = %d keys, want %d", tt.in, len(keys), len(tt.want))
+			}
+			for i, key := range keys {
+				if key.ID != tt.want[i] {
+					t.Errorf("ParseKeys(%q)[%d].ID = %q, want %q", tt.in, i, key.ID, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	oldKey := Key{ID: "old", Secret: []byte("old-secret")}
+	newKey := Key{ID: "new", Secret: []byte("new-secret")}
+	signed := New(newKey, oldKey).Sign(url.Values{"url": {"https://example.com/a.png"}, "w": {"100"}})
+	signedOld := New(oldKey).Sign(url.Values{"url": {"https://example.com/a.png"}})
+
+	tests := []struct {
+		name    string
+		signer  *Signer
+		values  func() url.Values
+		wantErr error
+	}{
+		{"valid", New(newKey), func() url.Values { return clone(signed) }, nil},
+		{"rotated key still accepted", New(newKey, oldKey), func() url.Values { return clone(signedOld) }, nil},
+		{"removed key", New(newKey), func() url.Values { return clone(signedOld) }, ErrUnknownKey},
+		{"missing signature", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Del(SignatureParam)
+			return v
+		}, ErrMissingSignature},
+		{"changed param", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Set("w", "200")
+			return v
+		}, ErrInvalidSignature},
+		{"added param", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Set("h", "200")
+			return v
+		}, ErrInvalidSignature},
+		{"removed param", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Del("w")
+			return v
+		}, ErrInvalidSignature},
+		{"tampered signature", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Set(SignatureParam, v.Get(SignatureParam)+"x")
+			return v
+		}, ErrInvalidSignature},
+		{"wrong key id", New(newKey), func() url.Values {
+			v := clone(signed)
+			v.Set(KeyIDParam, "other")
+			return v
+		}, ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.signer.Verify(tt.values()); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSignURL(t *testing.T) {
+	s := New(Key{ID: "k1", Secret: []byte("secret")})
+	signedUrl, err := s.SignURL("https://img.example.com/?url=https%3A%2F%2Fexample.com%2Fa.png&w=100&s=stale")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signedUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := u.Query()
+	if values.Get(KeyIDParam) != "k1" {
+		t.Errorf("kid = %q, want k1", values.Get(KeyIDParam))
+	}
+	if len(values[SignatureParam]) != 1 || values.Get(SignatureParam) == "stale" {
+		t.Errorf("signature not replaced: %v", values[SignatureParam])
+	}
+	if err := s.Verify(values); err != nil {
+		t.Errorf("Verify(SignURL()) = %v", err)
+	}
+}
+
+func clone(values url.Values) url.Values {
+	c := url.Values{}
+	for k, v := range values {
+		c[k] = append([]string(nil), v...)
+	}
+	return c
+}
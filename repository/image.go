@@ -5,22 +5,68 @@ import (
 	"time"
 
 	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/patrickn2/go-image-optimizer/pkg/metrics"
 )
 
 type ImageRepository struct {
-	db database.PkgDatabaseInterface
+	db      database.PkgDatabaseInterface
+	backend string
 }
 
-func NewImageRepository(db database.PkgDatabaseInterface) *ImageRepository {
+func NewImageRepository(db database.PkgDatabaseInterface, backend string) *ImageRepository {
 	return &ImageRepository{
-		db: db,
+		db:      db,
+		backend: backend,
 	}
 }
 
-func (ir *ImageRepository) GetImage(ctx context.Context, imageName string) ([]byte, *time.Time, error) {
-	return ir.db.Get(ctx, imageName)
+func (ir *ImageRepository) GetImage(ctx context.Context, imageName string) ([]byte, *database.Metadata, error) {
+	start := time.Now()
+	image, meta, err := ir.db.Get(ctx, imageName)
+	metrics.CacheOperationDuration.WithLabelValues(ir.backend, "get").Observe(time.Since(start).Seconds())
+	switch {
+	case err != nil:
+		metrics.CacheLookupsTotal.WithLabelValues(ir.backend, "error").Inc()
+	case image == nil:
+		metrics.CacheLookupsTotal.WithLabelValues(ir.backend, "miss").Inc()
+	default:
+		metrics.CacheLookupsTotal.WithLabelValues(ir.backend, "hit").Inc()
+	}
+	return image, meta, err
+}
+
+func (ir *ImageRepository) SaveImage(ctx context.Context, imageName string, image []byte, meta *database.Metadata) error {
+	start := time.Now()
+	err := ir.db.Set(ctx, imageName, image, meta)
+	metrics.CacheOperationDuration.WithLabelValues(ir.backend, "set").Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	if meta.SourceUrl != "" {
+		return ir.indexVariant(ctx, meta.SourceUrl, imageName)
+	}
+	return nil
+}
+
+// SavePermanentImage stores an image that never goes stale without the cache
+// expiration, on the backends supporting a TTL per entry
+func (ir *ImageRepository) SavePermanentImage(ctx context.Context, imageName string, image []byte, meta *database.Metadata) error {
+	db, ok := ir.db.(database.PkgDatabaseTTL)
+	if !ok {
+		return ir.SaveImage(ctx, imageName, image, meta)
+	}
+	start := time.Now()
+	err := db.SetWithTTL(ctx, imageName, image, meta, 0)
+	metrics.CacheOperationDuration.WithLabelValues(ir.backend, "set").Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Ping checks the cache backend is reachable
+func (ir *ImageRepository) Ping(ctx context.Context) error {
+	return ir.db.Ping(ctx)
 }
 
-func (ir *ImageRepository) SaveImage(ctx context.Context, imageName string, image []byte) error {
-	return ir.db.Set(ctx, imageName, image)
+// Close releases the cache backend connections
+func (ir *ImageRepository) Close() error {
+	return ir.db.Close()
 }
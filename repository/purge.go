@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+)
+
+// Every variant of a source image is stored with a key starting with the
+// source URL hash, so they can be found by prefix. Backends that can't list
+// their keys also track them in the <hash>_index set.
+const indexSuffix = "_index"
+
+// SourceHash returns the prefix of the cache keys of the source URL variants
+func SourceHash(sourceUrl string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(sourceUrl)))
+}
+
+func (ir *ImageRepository) indexVariant(ctx context.Context, sourceUrl, imageName string) error {
+	set, ok := ir.db.(database.PkgDatabaseSet)
+	if !ok {
+		return nil
+	}
+	return set.AddMember(ctx, SourceHash(sourceUrl)+indexSuffix, imageName)
+}
+
+// PurgeSource deletes every cached variant of the source URL and returns how many were deleted
+func (ir *ImageRepository) PurgeSource(ctx context.Context, sourceUrl string) (int, error) {
+	variants, err := ir.variants(ctx, sourceUrl)
+	if err != nil {
+		return 0, err
+	}
+	for _, variant := range variants {
+		if err := ir.db.Delete(ctx, variant); err != nil {
+			return 0, err
+		}
+	}
+	return len(variants), ir.db.Delete(ctx, SourceHash(sourceUrl)+indexSuffix)
+}
+
+// PurgeOutdated deletes the cached variants of the source URL generated from
+// another source image than the one with sourceDigest, the variants already
+// regenerated from it are kept. It returns how many were deleted.
+func (ir *ImageRepository) PurgeOutdated(ctx context.Context, sourceUrl, sourceDigest string) (int, error) {
+	variants, err := ir.variants(ctx, sourceUrl)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, variant := range variants {
+		meta, err := ir.metadata(ctx, variant)
+		if err != nil {
+			return purged, err
+		}
+		if meta == nil || meta.SourceDigest == sourceDigest {
+			continue
+		}
+		if err := ir.db.Delete(ctx, variant); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// variants returns the cache keys of the source URL variants
+func (ir *ImageRepository) variants(ctx context.Context, sourceUrl string) ([]string, error) {
+	hash := SourceHash(sourceUrl)
+	indexName := hash + indexSuffix
+	var variants []string
+	if set, ok := ir.db.(database.PkgDatabaseSet); ok {
+		members, err := set.Members(ctx, indexName)
+		if err != nil {
+			return nil, err
+		}
+		variants = members
+	}
+	keys, err := ir.db.Keys(ctx, hash+"_")
+	if err != nil && err != database.ErrKeysNotSupported {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key != indexName && !slices.Contains(variants, key) {
+			variants = append(variants, key)
+		}
+	}
+	return variants, nil
+}
+
+// SourceUrls lists the source URLs with cached variants, it returns
+// database.ErrKeysNotSupported when the backend can't list its keys
+func (ir *ImageRepository) SourceUrls(ctx context.Context) ([]string, error) {
+	keys, err := ir.db.Keys(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	var sourceUrls []string
+	for _, key := range keys {
+		// Keys start with the 64 hex characters of the source hash
+		if len(key) < 64 || seen[key[:64]] {
+			continue
+		}
+		meta, err := ir.metadata(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if meta != nil && meta.SourceUrl != "" {
+			seen[key[:64]] = true
+			sourceUrls = append(sourceUrls, meta.SourceUrl)
+		}
+	}
+	return sourceUrls, nil
+}
+
+// metadata reads only the metadata of the entry when the backend supports it,
+// so listing the cache doesn't read every image
+func (ir *ImageRepository) metadata(ctx context.Context, key string) (*database.Metadata, error) {
+	if metaDb, ok := ir.db.(database.PkgDatabaseMeta); ok {
+		return metaDb.GetMeta(ctx, key)
+	}
+	_, meta, err := ir.db.Get(ctx, key)
+	return meta, err
+}
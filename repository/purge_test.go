@@ -0,0 +1,125 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+)
+
+// setDatabase is a backend that can't list its keys and tracks the variants
+// in sets instead, like memcache
+type setDatabase struct {
+	*database.PkgDatabaseInMemory
+	sets map[string][]string
+}
+
+func (db *setDatabase) Keys(ctx context.Context, prefix string) ([]string, error) {
+	return nil, database.ErrKeysNotSupported
+}
+
+func (db *setDatabase) AddMember(ctx context.Context, key, member string) error {
+	db.sets[key] = append(db.sets[key], member)
+	return nil
+}
+
+func (db *setDatabase) Members(ctx context.Context, key string) ([]string, error) {
+	return db.sets[key], nil
+}
+
+func (db *setDatabase) Delete(ctx context.Context, key string) error {
+	delete(db.sets, key)
+	return db.PkgDatabaseInMemory.Delete(ctx, key)
+}
+
+const (
+	sourceA = "https://example.com/a.png"
+	sourceB = "https://example.com/b.png"
+)
+
+func saveVariants(t *testing.T, ir *ImageRepository) {
+	t.Helper()
+	variants := map[string]string{
+		SourceHash(sourceA) + "_80_100": sourceA,
+		SourceHash(sourceA) + "_80_200": sourceA,
+		SourceHash(sourceB) + "_80_100": sourceB,
+	}
+	for key, sourceUrl := range variants {
+		if err := ir.SaveImage(context.Background(), key, []byte("image"), &database.Metadata{SourceUrl: sourceUrl}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurgeSource(t *testing.T) {
+	tests := []struct {
+		name string
+		db   func(*database.PkgDatabaseInMemory) database.PkgDatabaseInterface
+	}{
+		{"keys", func(db *database.PkgDatabaseInMemory) database.PkgDatabaseInterface { return db }},
+		{"set", func(db *database.PkgDatabaseInMemory) database.PkgDatabaseInterface {
+			return &setDatabase{PkgDatabaseInMemory: db, sets: map[string][]string{}}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			memory := database.NewDatabaseInMemory(0, 0)
+			defer memory.Close()
+			db := tt.db(memory)
+			ir := NewImageRepository(db, tt.name)
+			saveVariants(t, ir)
+
+			variants, err := ir.PurgeSource(ctx, sourceA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if variants != 2 {
+				t.Errorf("PurgeSource() = %d variants, want 2", variants)
+			}
+			keys, _ := memory.Keys(ctx, "")
+			if want := []string{SourceHash(sourceB) + "_80_100"}; !slices.Equal(keys, want) {
+				t.Errorf("keys after purge = %v, want %v", keys, want)
+			}
+			if set, ok := db.(*setDatabase); ok {
+				if _, ok := set.sets[SourceHash(sourceA)+indexSuffix]; ok {
+					t.Error("index of the purged source not deleted")
+				}
+				if len(set.sets[SourceHash(sourceB)+indexSuffix]) != 1 {
+					t.Error("index of the other source modified")
+				}
+			}
+
+			if variants, err := ir.PurgeSource(ctx, sourceA); err != nil || variants != 0 {
+				t.Errorf("PurgeSource() again = %d, %v, want 0", variants, err)
+			}
+		})
+	}
+}
+
+func TestSourceUrls(t *testing.T) {
+	ctx := context.Background()
+	db := database.NewDatabaseInMemory(0, 0)
+	defer db.Close()
+	ir := NewImageRepository(db, "memory")
+	saveVariants(t, ir)
+
+	sourceUrls, err := ir.SourceUrls(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(sourceUrls)
+	if want := []string{sourceA, sourceB}; !slices.Equal(sourceUrls, want) {
+		t.Errorf("SourceUrls() = %v, want %v", sourceUrls, want)
+	}
+	if stats := db.Stats(); stats.Hits+stats.Misses != 0 {
+		t.Errorf("SourceUrls() read %d entries, want only their metadata", stats.Hits+stats.Misses)
+	}
+
+	set := NewImageRepository(&setDatabase{PkgDatabaseInMemory: db, sets: map[string][]string{}}, "set")
+	if _, err := set.SourceUrls(ctx); !errors.Is(err, database.ErrKeysNotSupported) {
+		t.Errorf("SourceUrls() without keys = %v, want ErrKeysNotSupported", err)
+	}
+}
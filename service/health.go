@@ -0,0 +1,18 @@
+package service
+
+import (
+	"context"
+)
+
+type HealthCheck struct {
+	Name string
+	Err  error
+}
+
+// Ready checks the dependencies needed to serve images
+func (is *ImageService) Ready(ctx context.Context) []HealthCheck {
+	return []HealthCheck{
+		{Name: "cache", Err: is.ir.Ping(ctx)},
+		{Name: "vips", Err: is.ic.Check()},
+	}
+}
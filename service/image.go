@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -14,22 +15,54 @@ import (
 	"strings"
 	"time"
 
+	"github.com/patrickn2/go-image-optimizer/pkg/accept"
+	"github.com/patrickn2/go-image-optimizer/pkg/coalesce"
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
 	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress"
+	"github.com/patrickn2/go-image-optimizer/pkg/imageformat"
+	"github.com/patrickn2/go-image-optimizer/pkg/metrics"
+	"github.com/patrickn2/go-image-optimizer/pkg/safehttp"
+	"github.com/patrickn2/go-image-optimizer/pkg/svgsanitizer"
 	"github.com/patrickn2/go-image-optimizer/repository"
 )
 
 type ImageService struct {
-	ir *repository.ImageRepository
-	ic imagecompress.PkgImgCompressInterface
+	ir       *repository.ImageRepository
+	ic       imagecompress.PkgImgCompressInterface
+	hc       *http.Client
+	inFlight coalesce.Group[*OptimizeResponse]
+	// revalidations coalesces the origin checks of all the variants of a source image
+	revalidations coalesce.Group[*sourceRevalidation]
 }
 
-func NewImageService(ic imagecompress.PkgImgCompressInterface, ir *repository.ImageRepository) *ImageService {
+func NewImageService(ic imagecompress.PkgImgCompressInterface, ir *repository.ImageRepository, hc *http.Client) *ImageService {
 	return &ImageService{
 		ir: ir,
 		ic: ic,
+		hc: hc,
 	}
 }
 
+// Wait blocks until the images being optimized in background finish, they
+// keep running after their requests are gone to get saved in the cache
+func (is *ImageService) Wait(ctx context.Context) error {
+	if err := is.inFlight.Wait(ctx); err != nil {
+		return err
+	}
+	return is.revalidations.Wait(ctx)
+}
+
+// SupportsFormat reports if images can be converted to the format
+func (is *ImageService) SupportsFormat(format string) bool {
+	return is.ic.SupportsFormat(format)
+}
+
+// CoalesceStats returns how many cache misses were processed and how many
+// waited for an identical request already in progress
+func (is *ImageService) CoalesceStats() coalesce.Stats {
+	return is.inFlight.Stats()
+}
+
 var (
 	ErrInvalidImageWidth   = errors.New("invalid image width")
 	ErrInvalidImageUrl     = errors.New("invalid image url")
@@ -37,15 +70,19 @@ var (
 	ErrInvalidImageType    = errors.New("invalid image type")
 	ErrInvalidImageSize    = errors.New("invalid image size")
 	ErrInvalidQuality      = errors.New("invalid quality")
-	ErrNotModified         = errors.New("not modified")
 	ErrTimeout             = errors.New("image download timeout")
+	ErrForbiddenAddress    = errors.New("image address not allowed")
+	ErrServerBusy          = errors.New("server too busy to process the image")
+	ErrImageTooLarge       = errors.New("image dimensions too large")
 )
 
 type OptimizeResponse struct {
 	ImageData   []byte
 	ImageFormat string
-	Modified    *time.Time
-	Cache       bool
+	// ETag is the strong entity tag of ImageData
+	ETag     string
+	Modified *time.Time
+	Cache    bool
 }
 
 type OptimizeRequest struct {
@@ -54,13 +91,28 @@ type OptimizeRequest struct {
 	Height               int
 	Width                int
 	Quality              int
-	IfModifiedSince      string
-	CacheControl         string
+	Fit                  string
+	Gravity              string
+	FocalX               float64
+	FocalY               float64
 	BrokenImage          bool
 	MaxImageSize         int64
 	AuthorizedDomains    string
 	ImageDownloadTimeout int
-	AcceptedFormats      []string
+	// Format forces the output format, empty negotiates it from AcceptedFormats
+	Format           string
+	AcceptedFormats  accept.MediaRanges
+	FormatPreference []string
+	// SvgMinify removes the comments, editor data and whitespace of the SVG images
+	SvgMinify bool
+	// Rasterize converts the SVG images to the output format, it is implied
+	// by a forced format or an Accept header not listing SVG
+	Rasterize bool
+	// RevalidateAfter is the age after which cached images are revalidated
+	// with the origin, 0 disables it. During StaleWhileRevalidate after that
+	// the cached image is served while it is revalidated in background.
+	RevalidateAfter      time.Duration
+	StaleWhileRevalidate time.Duration
 }
 
 func (is *ImageService) Optimize(or *OptimizeRequest) (*OptimizeResponse, error) {
@@ -69,212 +121,525 @@ func (is *ImageService) Optimize(or *OptimizeRequest) (*OptimizeResponse, error)
 		return nil, ErrInvalidImageUrl
 	}
 
+	var authorizedDomains *regexp.Regexp
 	if or.AuthorizedDomains != "" {
-		if !regexp.MustCompile(or.AuthorizedDomains).MatchString(u.Host) {
+		authorizedDomains = regexp.MustCompile(or.AuthorizedDomains)
+		if !authorizedDomains.MatchString(u.Host) {
 			return nil, ErrDomainNotAuthorized
 		}
 	}
 
-	acceptWebp := slices.Contains[[]string, string](or.AcceptedFormats, "image/webp")
+	format := or.Format
+	if format == "" {
+		format = negotiateFormat(or.AcceptedFormats, or.FormatPreference)
+	}
 
 	// Generate image name
-	s := sha256.New()
-	s.Write([]byte(or.ImageUrl))
-	imageName := fmt.Sprintf("%x_%d_%d_%d_%v", s.Sum(nil), or.Quality, or.Width, or.Height, acceptWebp)
+	params := fmt.Sprintf("%d_%d_%d_%s_%s", or.Quality, or.Width, or.Height, transformKey(or.Fit, or.Gravity, or.FocalX, or.FocalY), formatKey(format))
+	imageName := repository.SourceHash(or.ImageUrl) + "_" + params
 
 	// Check if image is in the cache
-	optimizedImage, modified, err := is.ir.GetImage(or.Ctx, imageName)
+	optimizedImage, meta, err := is.ir.GetImage(or.Ctx, imageName)
 	if err != nil {
 		return nil, err
 	}
-	if optimizedImage != nil {
-		log.Println("Image found in cache", imageName)
-		// Convert If-Modified-Since header to time.Time
-		var ifModified time.Time
-		if or.IfModifiedSince != "" {
-			ifModified, err = time.Parse(time.RFC1123, or.IfModifiedSince)
+	// Rasterized SVG images have their own name, the cached SVG tells the
+	// source is an SVG image. Until the source type is known the request uses
+	// the raster name, process stores other images under the image name.
+	if rasterizeSVG(or.Rasterize, or.Format, or.AcceptedFormats) && (optimizedImage == nil || cachedContentType(meta, optimizedImage) == imageformat.SVG) {
+		imageName, params = imageName+rasterSuffix, params+rasterSuffix
+		if optimizedImage != nil {
+			optimizedImage, meta, err = is.ir.GetImage(or.Ctx, imageName)
 			if err != nil {
-				ifModified = time.Now().UTC()
+				return nil, err
 			}
 		}
-		log.Println("Modified", modified)
-		// Check if image is modified and if cache is enabled and will return 304 Not Modified
-		if modified != nil && modified.After(ifModified) && or.CacheControl != "no-cache" && or.CacheControl != "no-store" && or.CacheControl != "" {
-			log.Println("Returning 304")
-			return &OptimizeResponse{
-				Modified: modified,
-				Cache:    true,
-			}, nil
-		}
-		log.Println("Returning Cache")
-		return &OptimizeResponse{
-			ImageData:   optimizedImage,
-			ImageFormat: http.DetectContentType(optimizedImage),
-			Modified:    modified,
-			Cache:       true,
-		}, nil
-	}
-
-	// Check image size
-	httpClient := &http.Client{
-		Timeout: time.Duration(or.ImageDownloadTimeout) * time.Second,
-	}
-	// Download Image Header
-	head, err := httpClient.Head(or.ImageUrl)
-	if err != nil || head.StatusCode != 200 {
-		if err == http.ErrHandlerTimeout {
-			return nil, ErrTimeout
-		}
-		return nil, ErrInvalidImageUrl
 	}
-	defer head.Body.Close()
-
-	// Check Image Size
-	if head.ContentLength > or.MaxImageSize {
-		return nil, ErrInvalidImageSize
+	if optimizedImage != nil && or.RevalidateAfter > 0 && meta.SourceUrl != "" {
+		age := time.Since(meta.Validated())
+		switch {
+		case age <= or.RevalidateAfter:
+			// Still fresh
+		case age <= or.RevalidateAfter+or.StaleWhileRevalidate:
+			is.revalidateInBackground(or, authorizedDomains, imageName, params, format, optimizedImage, meta)
+		default:
+			revalidated, err := is.revalidateOnce(or.Ctx, or, authorizedDomains, imageName, params, format, optimizedImage, meta)
+			if err != nil {
+				// Serving the stale image is better than failing while the origin is down
+				log.Printf("Error revalidating %s, serving stale image: %v\n", imageName, err)
+			} else if !revalidated.Cache {
+				return revalidated, nil
+			}
+		}
 	}
-	// Check if it is an image
-	if !strings.HasPrefix(head.Header.Get("Content-Type"), "image/") {
-		return nil, ErrInvalidImageType
+	if optimizedImage != nil {
+		log.Println("Image found in cache", imageName)
+		return cachedResponse(optimizedImage, meta), nil
 	}
 
-	// Download image
-	res, err := httpClient.Get(or.ImageUrl)
-	if err != nil || res.StatusCode != 200 {
-		if err == http.ErrHandlerTimeout {
-			return nil, ErrTimeout
-		}
-		return nil, ErrInvalidImageUrl
+	// Concurrent requests for the same image share a single download and compression
+	optimizedResponse, shared, err := is.inFlight.Do(or.Ctx, imageName, func(ctx context.Context) (*OptimizeResponse, error) {
+		return is.optimize(ctx, or, authorizedDomains, imageName, params, format)
+	})
+	if err != nil {
+		return nil, err
 	}
-	defer res.Body.Close()
+	if shared {
+		log.Println("Coalesced request for", imageName)
+	}
+	response := *optimizedResponse
+	return &response, nil
+}
 
-	var imageBuffer bytes.Buffer
-	_, err = imageBuffer.ReadFrom(res.Body)
+// optimize downloads, compresses and caches the image
+func (is *ImageService) optimize(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, imageName, params, format string) (*OptimizeResponse, error) {
+	origin, err := is.download(ctx, or, authorizedDomains, nil)
 	if err != nil {
 		return nil, err
 	}
+	return is.process(ctx, or, origin, imageName, params, format)
+}
 
+// process compresses and caches the downloaded image. Rasterized SVG images
+// are cached under the raster name with the sanitized SVG under the image
+// name, any other image under the image name.
+func (is *ImageService) process(ctx context.Context, or *OptimizeRequest, origin *originImage, imageName, params, format string) (*OptimizeResponse, error) {
 	// Check Image Type Again (Protection against type manipulation)
-	downloadedImageRealType := http.DetectContentType(imageBuffer.Bytes())
+	downloadedImageRealType := imageformat.Detect(origin.Data)
 	if !strings.HasPrefix(downloadedImageRealType, "image/") {
 		return nil, ErrInvalidImageType
 	}
 
-	newImageType := chooseImageFormat(downloadedImageRealType, or.AcceptedFormats)
+	newImageType := outputFormat(downloadedImageRealType, format, rasterizeSVG(or.Rasterize, or.Format, or.AcceptedFormats))
 	log.Println("Downloaded Image Type", downloadedImageRealType, "New Image Type", newImageType)
 
+	imageName, params = strings.TrimSuffix(imageName, rasterSuffix), strings.TrimSuffix(params, rasterSuffix)
+	if downloadedImageRealType == imageformat.SVG && newImageType != imageformat.SVG {
+		if _, err := is.store(ctx, or, origin, imageName, params, downloadedImageRealType, imageformat.SVG); err != nil {
+			return nil, err
+		}
+		imageName, params = imageName+rasterSuffix, params+rasterSuffix
+	}
+	return is.store(ctx, or, origin, imageName, params, downloadedImageRealType, newImageType)
+}
+
+// store transforms the downloaded image to the new image type and caches it
+func (is *ImageService) store(ctx context.Context, or *OptimizeRequest, origin *originImage, imageName, params, downloadedImageRealType, newImageType string) (*OptimizeResponse, error) {
 	// Resizing and compressing image
 	compressRequest := &imagecompress.CompressImageRequest{
-		ImageData: imageBuffer.Bytes(),
+		ImageData: origin.Data,
+		ImageType: downloadedImageRealType,
 		Quality:   or.Quality,
 		Width:     or.Width,
 		Height:    or.Height,
 		NewType:   newImageType,
+		Fit:       or.Fit,
+		Gravity:   or.Gravity,
+		FocalX:    or.FocalX,
+		FocalY:    or.FocalY,
 	}
-	compressedImage, err := is.ic.CompressImage(compressRequest)
+	compressResponse, err := is.transform(compressRequest, or.SvgMinify)
 	if err != nil {
 		return nil, err
 	}
+	compressedImage := compressResponse.ImageData
+	width, height := compressResponse.Width, compressResponse.Height
 
-	// If the mew image is bigger than the original image, save the old image instead of the new one
-	if len(compressedImage) > imageBuffer.Len() && newImageType == downloadedImageRealType {
-		compressedImage = imageBuffer.Bytes()
+	// If the mew image is bigger than the original image, save the old image instead of the new one.
+	// Only when it wasn't resized or cropped, and never for SVG, the original image is not sanitized.
+	sameSize := width == compressResponse.SourceWidth && height == compressResponse.SourceHeight
+	if len(compressedImage) > len(origin.Data) && sameSize && newImageType == downloadedImageRealType && newImageType != imageformat.SVG {
+		compressedImage = origin.Data
+		width, height = compressResponse.SourceWidth, compressResponse.SourceHeight
 	}
 
-	err = is.ir.SaveImage(or.Ctx, imageName, compressedImage)
+	meta := &database.Metadata{
+		ContentType:  newImageType,
+		Width:        width,
+		Height:       height,
+		Size:         len(compressedImage),
+		SourceUrl:    or.ImageUrl,
+		ETag:         origin.ETag,
+		LastModified: origin.LastModified,
+		Params:       params,
+		Digest:       digest(compressedImage),
+		SourceDigest: digest(origin.Data),
+		CreatedAt:    time.Now().UTC(),
+	}
+	err = is.ir.SaveImage(ctx, imageName, compressedImage, meta)
 	if err != nil {
 		log.Printf("Error saving Image to cache: %v\n", err)
 	}
 
-	if modified == nil {
-		m := time.Now().UTC()
-		modified = &m
-	}
 	return &OptimizeResponse{
 		ImageData:   compressedImage,
 		ImageFormat: newImageType,
-		Modified:    modified,
+		ETag:        strongETag(meta.Digest),
+		Modified:    &meta.CreatedAt,
 		Cache:       false,
 	}, nil
 }
 
+type originImage struct {
+	Data []byte
+	// ETag and LastModified are the origin response validators
+	ETag         string
+	LastModified string
+}
+
+// download fetches the image from the origin keeping track of its metrics
+func (is *ImageService) download(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, cached *database.Metadata) (*originImage, error) {
+	start := time.Now()
+	origin, err := is.fetch(ctx, or, authorizedDomains, cached)
+	result := "ok"
+	switch {
+	case err == errOriginNotModified:
+		result = "not_modified"
+	case err != nil:
+		result = "error"
+	}
+	metrics.OriginFetchDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	return origin, err
+}
+
+// fetch downloads the image from the origin checking its size and type. When
+// cached has the validators of a previous download the request is conditional
+// and errOriginNotModified is returned if the origin image didn't change.
+func (is *ImageService) fetch(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, cached *database.Metadata) (*originImage, error) {
+	httpClient := *is.hc
+	httpClient.Timeout = time.Duration(or.ImageDownloadTimeout) * time.Second
+	httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if authorizedDomains != nil && !authorizedDomains.MatchString(req.URL.Host) {
+			return ErrDomainNotAuthorized
+		}
+		if is.hc.CheckRedirect != nil {
+			return is.hc.CheckRedirect(req, via)
+		}
+		return nil
+	}
+	// Revalidations skip the HEAD request, the conditional GET response is checked instead
+	if cached == nil {
+		// Download Image Header
+		headRequest, err := http.NewRequestWithContext(ctx, http.MethodHead, or.ImageUrl, nil)
+		if err != nil {
+			return nil, ErrInvalidImageUrl
+		}
+		head, err := httpClient.Do(headRequest)
+		if err != nil || head.StatusCode != 200 {
+			if err == http.ErrHandlerTimeout {
+				return nil, ErrTimeout
+			}
+			if err != nil {
+				return nil, downloadError(err)
+			}
+			return nil, ErrInvalidImageUrl
+		}
+		defer head.Body.Close()
+		if err := checkOriginResponse(head, or.MaxImageSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Download image
+	getRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, or.ImageUrl, nil)
+	if err != nil {
+		return nil, ErrInvalidImageUrl
+	}
+	if cached != nil {
+		if cached.ETag != "" {
+			getRequest.Header.Set("If-None-Match", cached.ETag)
+		}
+		if cached.LastModified != "" {
+			getRequest.Header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+	res, err := httpClient.Do(getRequest)
+	if err == nil && res.StatusCode == http.StatusNotModified && cached != nil {
+		res.Body.Close()
+		return nil, errOriginNotModified
+	}
+	if err != nil || res.StatusCode != 200 {
+		if err == http.ErrHandlerTimeout {
+			return nil, ErrTimeout
+		}
+		if err != nil {
+			return nil, downloadError(err)
+		}
+		return nil, ErrInvalidImageUrl
+	}
+	defer res.Body.Close()
+	if cached != nil {
+		if err := checkOriginResponse(res, or.MaxImageSize); err != nil {
+			return nil, err
+		}
+	}
+
+	// Never trust the announced length, read one byte more than allowed to detect bigger images
+	var imageBuffer bytes.Buffer
+	_, err = imageBuffer.ReadFrom(io.LimitReader(res.Body, or.MaxImageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(imageBuffer.Len()) > or.MaxImageSize {
+		return nil, ErrInvalidImageSize
+	}
+	return &originImage{
+		Data:         imageBuffer.Bytes(),
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// checkOriginResponse checks the origin response announces an image not bigger than maxSize
+func checkOriginResponse(res *http.Response, maxSize int64) error {
+	// Check Image Size
+	if res.ContentLength > maxSize {
+		return ErrInvalidImageSize
+	}
+	// Check if it is an image, generic binary content is sniffed after the download
+	contentType := res.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") && !strings.HasPrefix(contentType, "application/octet-stream") {
+		return ErrInvalidImageType
+	}
+	return nil
+}
+
+// transform compresses the image, SVG images are sanitized first and only
+// rasterized if the output format isn't SVG
+func (is *ImageService) transform(c *imagecompress.CompressImageRequest, svgMinify bool) (*imagecompress.CompressImageResponse, error) {
+	if c.ImageType != imageformat.SVG {
+		return is.compress(c)
+	}
+	sanitized, err := svgsanitizer.Sanitize(c.ImageData, svgMinify)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return nil, ErrInvalidImageType
+	}
+	if c.NewType != imageformat.SVG {
+		rasterizeRequest := *c
+		rasterizeRequest.ImageData = sanitized
+		return is.compress(&rasterizeRequest)
+	}
+	response := &imagecompress.CompressImageResponse{ImageData: sanitized}
+	if info, err := imageformat.Probe(sanitized); err == nil {
+		response.Width, response.Height = info.Width, info.Height
+		response.SourceWidth, response.SourceHeight = info.Width, info.Height
+	}
+	return response, nil
+}
+
+// compress runs the image transformation keeping track of its metrics
+func (is *ImageService) compress(c *imagecompress.CompressImageRequest) (*imagecompress.CompressImageResponse, error) {
+	metrics.TransformsInFlight.Inc()
+	defer metrics.TransformsInFlight.Dec()
+	start := time.Now()
+	compressResponse, err := is.ic.CompressImage(c)
+	if err != nil {
+		return nil, compressError(err)
+	}
+	metrics.TransformDuration.WithLabelValues(c.NewType).Observe(time.Since(start).Seconds())
+	metrics.SourceBytesTotal.Add(float64(len(c.ImageData)))
+	metrics.OutputBytesTotal.Add(float64(len(compressResponse.ImageData)))
+	return compressResponse, nil
+}
+
+// cachedResponse builds the response of an image found in the cache
+func cachedResponse(image []byte, meta *database.Metadata) *OptimizeResponse {
+	return &OptimizeResponse{
+		ImageData:   image,
+		ImageFormat: cachedContentType(meta, image),
+		ETag:        strongETag(cachedDigest(meta, image)),
+		Modified:    &meta.CreatedAt,
+		Cache:       true,
+	}
+}
+
+// cachedContentType returns the content type stored with the image, entries
+// without it are sniffed
+func cachedContentType(meta *database.Metadata, image []byte) string {
+	if meta.ContentType != "" {
+		return meta.ContentType
+	}
+	return imageformat.Detect(image)
+}
+
+// cachedDigest returns the digest stored with the image, entries without it are hashed
+func cachedDigest(meta *database.Metadata, image []byte) string {
+	if meta.Digest != "" {
+		return meta.Digest
+	}
+	return digest(image)
+}
+
+func digest(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// strongETag builds the entity tag from the first 128 bits of the digest
+func strongETag(digest string) string {
+	return `"` + digest[:32] + `"`
+}
+
+// downloadError converts the origin download errors that must not fall back to the broken image
+func downloadError(err error) error {
+	switch {
+	case errors.Is(err, safehttp.ErrAddressNotAllowed):
+		return ErrForbiddenAddress
+	case errors.Is(err, ErrDomainNotAuthorized):
+		return ErrDomainNotAuthorized
+	default:
+		return ErrInvalidImageUrl
+	}
+}
+
+func compressError(err error) error {
+	if errors.Is(err, imagecompress.ErrQueueFull) || errors.Is(err, imagecompress.ErrQueueTimeout) {
+		return ErrServerBusy
+	}
+	if errors.Is(err, imagecompress.ErrImageTooLarge) {
+		log.Printf("%v\n", err)
+		return ErrImageTooLarge
+	}
+	return err
+}
+
 type BrokenImageRequest struct {
-	Ctx             context.Context
-	Quality         int
-	Width           int
-	Height          int
-	BrokenImageData []byte
-	AcceptedFormats []string
+	Ctx              context.Context
+	Quality          int
+	Width            int
+	Height           int
+	Fit              string
+	Gravity          string
+	FocalX           float64
+	FocalY           float64
+	BrokenImageData  []byte
+	Format           string
+	AcceptedFormats  accept.MediaRanges
+	FormatPreference []string
+	SvgMinify        bool
+	Rasterize        bool
 }
 
 func (is *ImageService) BrokenImage(bir *BrokenImageRequest) (*OptimizeResponse, error) {
-	acceptWebp := slices.Contains[[]string, string](bir.AcceptedFormats, "image/webp")
-	brokenImageName := fmt.Sprintf("broken_%d_%d_%d_%v", bir.Quality, bir.Width, bir.Height, acceptWebp)
-	compressedImage, modified, err := is.ir.GetImage(bir.Ctx, brokenImageName)
+	format := bir.Format
+	if format == "" {
+		format = negotiateFormat(bir.AcceptedFormats, bir.FormatPreference)
+	}
+	params := fmt.Sprintf("%d_%d_%d_%s_%s", bir.Quality, bir.Width, bir.Height, transformKey(bir.Fit, bir.Gravity, bir.FocalX, bir.FocalY), formatKey(format))
+	brokenImageType := imageformat.Detect(bir.BrokenImageData)
+	newImageType := outputFormat(brokenImageType, format, rasterizeSVG(bir.Rasterize, bir.Format, bir.AcceptedFormats))
+	if brokenImageType == imageformat.SVG && newImageType != imageformat.SVG {
+		params += rasterSuffix
+	}
+	brokenImageName := "broken_" + params
+	compressedImage, meta, err := is.ir.GetImage(bir.Ctx, brokenImageName)
 	if err != nil {
 		return nil, err
 	}
 	if compressedImage != nil {
-		return &OptimizeResponse{
-			ImageData:   compressedImage,
-			ImageFormat: http.DetectContentType(compressedImage),
-			Modified:    modified,
-			Cache:       true,
-		}, nil
+		return cachedResponse(compressedImage, meta), nil
 	}
 
-	newImageType := chooseImageFormat(http.DetectContentType(bir.BrokenImageData), bir.AcceptedFormats)
-
 	compressRequest := &imagecompress.CompressImageRequest{
 		ImageData: bir.BrokenImageData,
+		ImageType: brokenImageType,
 		Quality:   bir.Quality,
 		Width:     bir.Width,
 		Height:    bir.Height,
 		NewType:   newImageType,
+		Fit:       bir.Fit,
+		Gravity:   bir.Gravity,
+		FocalX:    bir.FocalX,
+		FocalY:    bir.FocalY,
 	}
 
-	compressedImage, err = is.ic.CompressImage(compressRequest)
+	compressResponse, err := is.transform(compressRequest, bir.SvgMinify)
 	if err != nil {
 		return nil, err
 	}
-	err = is.ir.SaveImage(bir.Ctx, brokenImageName, compressedImage)
+	meta = &database.Metadata{
+		ContentType: newImageType,
+		Width:       compressResponse.Width,
+		Height:      compressResponse.Height,
+		Size:        len(compressResponse.ImageData),
+		Params:      params,
+		Digest:      digest(compressResponse.ImageData),
+		CreatedAt:   time.Now().UTC(),
+	}
+	// The broken image is loaded at startup, its variants never go stale
+	err = is.ir.SavePermanentImage(bir.Ctx, brokenImageName, compressResponse.ImageData, meta)
 	if err != nil {
 		log.Printf("Error saving Broken Image to cache: %v\n", err)
 	}
-	if modified == nil {
-		m := time.Now().UTC()
-		modified = &m
-	}
 	return &OptimizeResponse{
-		ImageData:   compressedImage,
+		ImageData:   compressResponse.ImageData,
 		ImageFormat: newImageType,
-		Modified:    modified,
+		ETag:        strongETag(meta.Digest),
+		Modified:    &meta.CreatedAt,
 		Cache:       false,
 	}, nil
 }
 
-func chooseImageFormat(imageFormat string, acceptFormats []string) string {
-	var acceptAvif bool
-	if imageFormat == "image/svg+xml" {
-		return "image/svg+xml"
+// transformKey is the cache key part for the fit and gravity params
+func transformKey(fit, gravity string, focalX, focalY float64) string {
+	if gravity == imagecompress.GravityFocalPoint {
+		return fmt.Sprintf("%s_%s-%.4f-%.4f", fit, gravity, focalX, focalY)
 	}
-	for _, format := range acceptFormats {
-		switch format {
-		case "image/webp":
-			return "image/webp"
-		case "image/avif":
-			acceptAvif = true
-		}
+	return fmt.Sprintf("%s_%s", fit, gravity)
+}
+
+// negotiateFormat returns the preferred format with the highest weight in the
+// Accept header, FORMAT_PREFERENCE breaks the ties. Empty keeps the original format.
+func negotiateFormat(accepted accept.MediaRanges, preference []string) string {
+	return accepted.Preferred(preference)
+}
+
+// formatKey is the cache key part for the negotiated format
+func formatKey(format string) string {
+	if format == "" {
+		return "original"
 	}
-	switch imageFormat {
-	case "image/webp":
-		return "image/png"
-	case "image/avif":
-		if acceptAvif {
-			return "image/avif"
-		}
-		return "image/png"
-	default:
+	return strings.TrimPrefix(format, "image/")
+}
+
+// sourceOnlyFormats are loaded by libvips but not supported by browsers, they
+// are always converted to a web safe format. Photos go to JPEG, the others
+// to PNG to keep their transparency. BMP is decoded by govips in Go, it
+// doesn't need the ImageMagick loader. ICO is out of scope, it's only loaded
+// through ImageMagick, which the image doesn't ship.
+var sourceOnlyFormats = map[string]string{
+	imageformat.HEIC: imageformat.JPEG,
+	imageformat.HEIF: imageformat.JPEG,
+	imageformat.TIFF: imageformat.PNG,
+	imageformat.BMP:  imageformat.PNG,
+}
+
+// rasterSuffix ends the names of the rasterized SVG images
+const rasterSuffix = "_raster"
+
+// rasterizeSVG reports if SVG images must be converted to a raster format
+func rasterizeSVG(rasterize bool, format string, accepted accept.MediaRanges) bool {
+	return rasterize || format != "" || !accepted.Explicit(imageformat.SVG)
+}
+
+// outputFormat returns the format of the new image for the source image
+// format and the negotiated format
+func outputFormat(imageFormat, format string, rasterize bool) string {
+	if imageFormat == imageformat.SVG && !rasterize {
 		return imageFormat
 	}
+	if format != "" {
+		return format
+	}
+	if imageFormat == imageformat.SVG {
+		return imageformat.PNG
+	}
+	if webSafe, ok := sourceOnlyFormats[imageFormat]; ok {
+		return webSafe
+	}
+	// Not every client supports them, fall back to a lossless format
+	if slices.Contains(imagecompress.NegotiatedFormats, imageFormat) {
+		return "image/png"
+	}
+	return imageFormat
 }
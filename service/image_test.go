@@ -0,0 +1,231 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/accept"
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress/imagecompresstest"
+	"github.com/patrickn2/go-image-optimizer/pkg/imageformat"
+	"github.com/patrickn2/go-image-optimizer/repository"
+)
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// params is the cache key part of the test requests
+const params = "80_8_0___original"
+
+var testSVG = []byte(`<svg xmlns="http://www.w3.org/2000/svg" width="8" height="8"><rect width="8" height="8"/></svg>`)
+
+func newTestService(t *testing.T, files map[string][]byte) (*ImageService, *database.PkgDatabaseInMemory, string) {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(data)
+	}))
+	t.Cleanup(origin.Close)
+	db := database.NewDatabaseInMemory(0, 0)
+	return NewImageService(imagecompresstest.Passthrough{}, repository.NewImageRepository(db, "in-memory"), origin.Client()), db, origin.URL
+}
+
+func optimizeRequest(imageUrl, acceptHeader string) *OptimizeRequest {
+	return &OptimizeRequest{
+		Ctx:                  context.Background(),
+		ImageUrl:             imageUrl,
+		Quality:              80,
+		Width:                8,
+		MaxImageSize:         1 << 20,
+		ImageDownloadTimeout: 5,
+		AcceptedFormats:      accept.Parse(acceptHeader),
+	}
+}
+
+// cacheKeys returns the params part of the cached variants of the source
+func cacheKeys(t *testing.T, db *database.PkgDatabaseInMemory, sourceUrl string) []string {
+	t.Helper()
+	prefix := repository.SourceHash(sourceUrl) + "_"
+	keys, err := db.Keys(context.Background(), prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, prefix)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestRasterizeKeepsRasterKeys(t *testing.T) {
+	is, db, originUrl := newTestService(t, map[string][]byte{"/a.png": testPNG(t)})
+	imageUrl := originUrl + "/a.png"
+
+	for _, acceptHeader := range []string{"image/webp,*/*", "image/svg+xml,*/*", ""} {
+		res, err := is.Optimize(optimizeRequest(imageUrl, acceptHeader))
+		if err != nil {
+			t.Fatalf("Accept %q: %v", acceptHeader, err)
+		}
+		if res.ImageFormat != imageformat.PNG {
+			t.Errorf("Accept %q: format = %s, want %s", acceptHeader, res.ImageFormat, imageformat.PNG)
+		}
+	}
+	if keys := cacheKeys(t, db, imageUrl); !slices.Equal(keys, []string{params}) {
+		t.Errorf("cache keys = %v, want [%s]", keys, params)
+	}
+}
+
+func TestRasterizeSvg(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept []string
+		want   []string
+		cached []bool
+	}{
+		{"svg accepted", []string{"image/svg+xml,*/*"}, []string{imageformat.SVG}, []bool{false}},
+		{"svg not accepted", []string{"*/*"}, []string{imageformat.PNG}, []bool{false}},
+		{"svg then raster", []string{"image/svg+xml,*/*", "*/*", "*/*", "image/svg+xml"}, []string{imageformat.SVG, imageformat.PNG, imageformat.PNG, imageformat.SVG}, []bool{false, false, true, true}},
+		{"raster then svg", []string{"*/*", "image/svg+xml", "*/*"}, []string{imageformat.PNG, imageformat.SVG, imageformat.PNG}, []bool{false, true, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is, db, originUrl := newTestService(t, map[string][]byte{"/a.svg": testSVG})
+			imageUrl := originUrl + "/a.svg"
+			for i, acceptHeader := range tt.accept {
+				res, err := is.Optimize(optimizeRequest(imageUrl, acceptHeader))
+				if err != nil {
+					t.Fatalf("request %d: %v", i, err)
+				}
+				if res.ImageFormat != tt.want[i] {
+					t.Errorf("request %d: format = %s, want %s", i, res.ImageFormat, tt.want[i])
+				}
+				if res.Cache != tt.cached[i] {
+					t.Errorf("request %d: cache = %v, want %v", i, res.Cache, tt.cached[i])
+				}
+			}
+			keys := cacheKeys(t, db, imageUrl)
+			want := []string{params}
+			if slices.Contains(tt.want, imageformat.PNG) {
+				want = append(want, params+rasterSuffix)
+			}
+			if !slices.Equal(keys, want) {
+				t.Errorf("cache keys = %v, want %v", keys, want)
+			}
+		})
+	}
+}
+
+func TestBrokenImageRasterKey(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		key  string
+	}{
+		{"png", testPNG(t), "broken_80_0_0___original"},
+		{"svg", testSVG, "broken_80_0_0___original" + rasterSuffix},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is, db, _ := newTestService(t, nil)
+			res, err := is.BrokenImage(&BrokenImageRequest{
+				Ctx:             context.Background(),
+				Quality:         80,
+				BrokenImageData: tt.data,
+				AcceptedFormats: accept.Parse("*/*"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ImageFormat != imageformat.PNG {
+				t.Errorf("format = %s, want %s", res.ImageFormat, imageformat.PNG)
+			}
+			if keys, _ := db.Keys(context.Background(), "broken_"); !slices.Equal(keys, []string{tt.key}) {
+				t.Errorf("cache keys = %v, want [%s]", keys, tt.key)
+			}
+		})
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := []struct {
+		imageFormat string
+		format      string
+		rasterize   bool
+		want        string
+	}{
+		{imageformat.HEIC, "", false, imageformat.JPEG},
+		{imageformat.HEIF, "", false, imageformat.JPEG},
+		{imageformat.TIFF, "", false, imageformat.PNG},
+		{imageformat.BMP, "", false, imageformat.PNG},
+		{imageformat.HEIC, imageformat.WEBP, false, imageformat.WEBP},
+		{imageformat.TIFF, imageformat.AVIF, false, imageformat.AVIF},
+		{imageformat.JPEG, "", false, imageformat.JPEG},
+		{imageformat.AVIF, "", false, imageformat.PNG},
+		{imageformat.SVG, "", false, imageformat.SVG},
+		{imageformat.SVG, "", true, imageformat.PNG},
+		{imageformat.SVG, imageformat.WEBP, true, imageformat.WEBP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.imageFormat+" to "+tt.format, func(t *testing.T) {
+			if got := outputFormat(tt.imageFormat, tt.format, tt.rasterize); got != tt.want {
+				t.Errorf("outputFormat(%s, %q, %v) = %s, want %s", tt.imageFormat, tt.format, tt.rasterize, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSourceOnlyFormatsIngestion(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"heic", []byte("\x00\x00\x00\x14ftypheic\x00\x00\x00\x00mif1\x00\x00\x00\x14ispe\x00\x00\x00\x00\x00\x00\x00\x08\x00\x00\x00\x08"), imageformat.JPEG},
+		{"heif", []byte("\x00\x00\x00\x10ftypmif1\x00\x00\x00\x00\x00\x00\x00\x14ispe\x00\x00\x00\x00\x00\x00\x00\x08\x00\x00\x00\x08"), imageformat.JPEG},
+		{"tiff", []byte("II\x2a\x00\x08\x00\x00\x00\x00\x00"), imageformat.PNG},
+		{"bmp", append([]byte("BM\x00\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00\x28\x00\x00\x00\x08\x00\x00\x00\x08\x00\x00\x00"), make([]byte, 28)...), imageformat.PNG},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is, db, originUrl := newTestService(t, map[string][]byte{"/image": tt.data})
+			imageUrl := originUrl + "/image"
+			negotiated := optimizeRequest(imageUrl, "image/webp,*/*;q=0.8")
+			negotiated.FormatPreference = []string{imageformat.WEBP}
+			res, err := is.Optimize(negotiated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ImageFormat != imageformat.WEBP {
+				t.Errorf("negotiated format = %s, want %s", res.ImageFormat, imageformat.WEBP)
+			}
+			res, err = is.Optimize(optimizeRequest(imageUrl, ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ImageFormat != tt.want {
+				t.Errorf("format = %s, want %s", res.ImageFormat, tt.want)
+			}
+			if keys := cacheKeys(t, db, imageUrl); len(keys) != 2 {
+				t.Errorf("cache keys = %v, want the negotiated and the original variants", keys)
+			}
+		})
+	}
+}
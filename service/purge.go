@@ -0,0 +1,80 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+)
+
+var (
+	ErrInvalidPurge      = errors.New("exactly one of url, prefix or glob is required")
+	ErrPurgeNotSupported = errors.New("purge by prefix or glob is not supported by the cache backend")
+)
+
+type PurgeRequest struct {
+	Ctx    context.Context
+	Url    string
+	Prefix string
+	Glob   string
+}
+
+type PurgeResponse struct {
+	SourceUrls int `json:"source_urls"`
+	Variants   int `json:"variants"`
+}
+
+// Purge deletes every cached variant of the source URLs matching the request
+func (is *ImageService) Purge(pr *PurgeRequest) (*PurgeResponse, error) {
+	var match func(string) bool
+	switch {
+	case pr.Url != "" && pr.Prefix == "" && pr.Glob == "":
+		variants, err := is.ir.PurgeSource(pr.Ctx, pr.Url)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Purged %d variants of %s\n", variants, pr.Url)
+		return &PurgeResponse{SourceUrls: 1, Variants: variants}, nil
+	case pr.Prefix != "" && pr.Url == "" && pr.Glob == "":
+		match = func(u string) bool { return strings.HasPrefix(u, pr.Prefix) }
+	case pr.Glob != "" && pr.Url == "" && pr.Prefix == "":
+		re := globToRegexp(pr.Glob)
+		match = re.MatchString
+	default:
+		return nil, ErrInvalidPurge
+	}
+
+	sourceUrls, err := is.ir.SourceUrls(pr.Ctx)
+	if err != nil {
+		if errors.Is(err, database.ErrKeysNotSupported) {
+			return nil, ErrPurgeNotSupported
+		}
+		return nil, err
+	}
+	response := &PurgeResponse{}
+	for _, sourceUrl := range sourceUrls {
+		if !match(sourceUrl) {
+			continue
+		}
+		variants, err := is.ir.PurgeSource(pr.Ctx, sourceUrl)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Purged %d variants of %s\n", variants, sourceUrl)
+		response.SourceUrls++
+		response.Variants += variants
+	}
+	return response, nil
+}
+
+// globToRegexp converts a glob where * matches any sequence of characters,
+// including slashes, and ? matches a single character
+func globToRegexp(glob string) *regexp.Regexp {
+	pattern := regexp.QuoteMeta(glob)
+	pattern = strings.ReplaceAll(pattern, `\*`, ".*")
+	pattern = strings.ReplaceAll(pattern, `\?`, ".")
+	return regexp.MustCompile("^" + pattern + "$")
+}
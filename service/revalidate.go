@@ -0,0 +1,128 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/patrickn2/go-image-optimizer/repository"
+)
+
+// errOriginNotModified is returned by download when the conditional request gets a 304
+var errOriginNotModified = errors.New("origin image not modified")
+
+// revalidateOnce revalidates the cached image, concurrent revalidations of the same image share the result
+func (is *ImageService) revalidateOnce(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, imageName, params, format string, cachedImage []byte, meta *database.Metadata) (*OptimizeResponse, error) {
+	response, _, err := is.inFlight.Do(ctx, "revalidate_"+imageName, func(ctx context.Context) (*OptimizeResponse, error) {
+		return is.revalidate(ctx, or, authorizedDomains, imageName, params, format, cachedImage, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	revalidated := *response
+	return &revalidated, nil
+}
+
+// revalidateInBackground revalidates the cached image without making the
+// request wait for it, Wait waits for it during the shutdown
+func (is *ImageService) revalidateInBackground(or *OptimizeRequest, authorizedDomains *regexp.Regexp, imageName, params, format string, cachedImage []byte, meta *database.Metadata) {
+	is.inFlight.Go(or.Ctx, "revalidate_"+imageName, func(ctx context.Context) (*OptimizeResponse, error) {
+		response, err := is.revalidate(ctx, or, authorizedDomains, imageName, params, format, cachedImage, meta)
+		if err != nil {
+			log.Printf("Error revalidating %s: %v\n", imageName, err)
+		}
+		return response, err
+	})
+}
+
+// sourceRevalidation is the result of the conditional request to the origin,
+// shared by the revalidations of every variant of the source image
+type sourceRevalidation struct {
+	// Origin is the downloaded image, nil when the origin answered 304 Not Modified
+	Origin *originImage
+	// Digest is the sha256 of the current source image, empty when unknown
+	Digest string
+}
+
+// unchanged reports if the cached variant was generated from the current source image
+func (rv *sourceRevalidation) unchanged(meta *database.Metadata) bool {
+	if meta.SourceDigest != "" && rv.Digest != "" {
+		return rv.Digest == meta.SourceDigest
+	}
+	return rv.Origin == nil
+}
+
+// revalidate checks the source image of the cached variant with the origin.
+// If it didn't change the cache entry is extended, otherwise the variant is
+// regenerated from the new origin image. Concurrent revalidations of any
+// variant of the same source image share the origin request.
+func (is *ImageService) revalidate(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, imageName, params, format string, cachedImage []byte, meta *database.Metadata) (*OptimizeResponse, error) {
+	rv, _, err := is.revalidations.Do(ctx, repository.SourceHash(meta.SourceUrl), func(ctx context.Context) (*sourceRevalidation, error) {
+		return is.revalidateSource(ctx, or, authorizedDomains, meta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rv.unchanged(meta) {
+		return is.extend(ctx, imageName, cachedImage, meta, rv.Origin), nil
+	}
+
+	origin := rv.Origin
+	if origin == nil {
+		// The variant is older than the validators the origin confirmed
+		origin, err = is.download(ctx, or, authorizedDomains, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Println("Origin image modified, regenerating", imageName)
+	return is.process(ctx, or, origin, imageName, params, format)
+}
+
+// revalidateSource sends a conditional request to the origin with the
+// validators of the cached variant. When the source image changed the
+// variants generated from the previous one are purged, the ones already
+// regenerated from the new one are kept. Origins ignoring the validators
+// answer with the full image, it is compared with the cached source digest.
+func (is *ImageService) revalidateSource(ctx context.Context, or *OptimizeRequest, authorizedDomains *regexp.Regexp, meta *database.Metadata) (*sourceRevalidation, error) {
+	origin, err := is.download(ctx, or, authorizedDomains, meta)
+	if err == errOriginNotModified {
+		log.Println("Origin image not modified", meta.SourceUrl)
+		return &sourceRevalidation{Digest: meta.SourceDigest}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rv := &sourceRevalidation{Origin: origin, Digest: digest(origin.Data)}
+	if rv.Digest == meta.SourceDigest {
+		log.Println("Origin image unchanged", meta.SourceUrl)
+		return rv, nil
+	}
+
+	purged, err := is.ir.PurgeOutdated(ctx, meta.SourceUrl, rv.Digest)
+	if err != nil {
+		log.Printf("Error purging the variants of %s: %v\n", meta.SourceUrl, err)
+	} else {
+		log.Printf("Origin image modified, purged %d variants of %s\n", purged, meta.SourceUrl)
+	}
+	return rv, nil
+}
+
+// extend saves the cached image as validated now, with the new origin
+// validators when the origin sent the full image again
+func (is *ImageService) extend(ctx context.Context, imageName string, cachedImage []byte, meta *database.Metadata, origin *originImage) *OptimizeResponse {
+	revalidated := *meta
+	revalidated.ValidatedAt = time.Now().UTC()
+	revalidated.Digest = cachedDigest(meta, cachedImage)
+	if origin != nil {
+		revalidated.ETag = origin.ETag
+		revalidated.LastModified = origin.LastModified
+	}
+	if err := is.ir.SaveImage(ctx, imageName, cachedImage, &revalidated); err != nil {
+		log.Printf("Error saving Image to cache: %v\n", err)
+	}
+	return cachedResponse(cachedImage, meta)
+}
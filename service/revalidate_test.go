@@ -0,0 +1,219 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress/imagecompresstest"
+	"github.com/patrickn2/go-image-optimizer/repository"
+)
+
+func filledPNG(t *testing.T, gray uint8) []byte {
+	t.Helper()
+	img := image.NewGray(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Gray{Y: gray}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// revalidationOrigin serves one image with an ETag, answering the
+// conditional requests unless it ignores the validators
+type revalidationOrigin struct {
+	mu               sync.Mutex
+	data             []byte
+	etag             string
+	ignoreValidators bool
+	// conditionalGets counts the revalidation requests
+	conditionalGets int
+	// block holds the revalidation requests until it's closed
+	block chan struct{}
+}
+
+func (o *revalidationOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	data, etag, ignoreValidators, block := o.data, o.etag, o.ignoreValidators, o.block
+	conditional := r.Method == http.MethodGet && r.Header.Get("If-None-Match") != ""
+	if conditional {
+		o.conditionalGets++
+	}
+	o.mu.Unlock()
+	if conditional && block != nil {
+		<-block
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("ETag", etag)
+	if conditional && !ignoreValidators && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(data)
+}
+
+func (o *revalidationOrigin) update(f func(o *revalidationOrigin)) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	f(o)
+}
+
+func (o *revalidationOrigin) gets() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.conditionalGets
+}
+
+func newRevalidationService(t *testing.T) (*ImageService, *database.PkgDatabaseInMemory, *revalidationOrigin, string) {
+	t.Helper()
+	origin := &revalidationOrigin{data: filledPNG(t, 0), etag: `"v1"`}
+	server := httptest.NewServer(origin)
+	t.Cleanup(server.Close)
+	db := database.NewDatabaseInMemory(0, 0)
+	is := NewImageService(imagecompresstest.Passthrough{}, repository.NewImageRepository(db, "in-memory"), server.Client())
+	return is, db, origin, server.URL + "/a.png"
+}
+
+// staleRequest requests the variant of the given width with every cached image due for revalidation
+func staleRequest(imageUrl string, width int, staleWhileRevalidate time.Duration) *OptimizeRequest {
+	or := optimizeRequest(imageUrl, "")
+	or.Width = width
+	or.RevalidateAfter = time.Nanosecond
+	or.StaleWhileRevalidate = staleWhileRevalidate
+	return or
+}
+
+func optimize(t *testing.T, is *ImageService, or *OptimizeRequest) *OptimizeResponse {
+	t.Helper()
+	res, err := is.Optimize(or)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func sourceDigest(t *testing.T, db *database.PkgDatabaseInMemory, key string) string {
+	t.Helper()
+	_, meta, err := db.Get(context.Background(), key)
+	if err != nil || meta == nil {
+		t.Fatalf("%s not cached: %v", key, err)
+	}
+	return meta.SourceDigest
+}
+
+func TestRevalidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *revalidationOrigin)
+		cached bool
+		keys   []string
+	}{
+		{"not modified", func(o *revalidationOrigin) {}, true, []string{"80_4_0___original", params}},
+		{"unchanged without validators", func(o *revalidationOrigin) { o.ignoreValidators = true }, true, []string{"80_4_0___original", params}},
+		{"modified", func(o *revalidationOrigin) { o.data, o.etag = filledPNG(t, 255), `"v2"` }, false, []string{params}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			is, db, origin, imageUrl := newRevalidationService(t)
+			optimize(t, is, optimizeRequest(imageUrl, ""))
+			sibling := optimizeRequest(imageUrl, "")
+			sibling.Width = 4
+			optimize(t, is, sibling)
+			origin.update(tt.change)
+
+			res := optimize(t, is, staleRequest(imageUrl, 8, 0))
+			if res.Cache != tt.cached {
+				t.Errorf("Cache = %v, want %v", res.Cache, tt.cached)
+			}
+			origin.mu.Lock()
+			data := origin.data
+			origin.mu.Unlock()
+			if !bytes.Equal(res.ImageData, data) {
+				t.Error("response is not the current origin image")
+			}
+			if gets := origin.gets(); gets != 1 {
+				t.Errorf("conditional requests = %d, want 1", gets)
+			}
+			if keys := cacheKeys(t, db, imageUrl); !slices.Equal(keys, tt.keys) {
+				t.Errorf("cache keys = %v, want %v", keys, tt.keys)
+			}
+			_, meta, _ := db.Get(context.Background(), repository.SourceHash(imageUrl)+"_"+params)
+			if tt.cached && !meta.ValidatedAt.After(meta.CreatedAt) {
+				t.Error("revalidated entry not extended")
+			}
+		})
+	}
+}
+
+func TestRevalidateSiblingsShareOriginRequest(t *testing.T) {
+	is, db, origin, imageUrl := newRevalidationService(t)
+	widths := []int{8, 4}
+	for _, width := range widths {
+		or := optimizeRequest(imageUrl, "")
+		or.Width = width
+		optimize(t, is, or)
+	}
+	modified := filledPNG(t, 255)
+	block := make(chan struct{})
+	origin.update(func(o *revalidationOrigin) { o.data, o.etag, o.block = modified, `"v2"`, block })
+
+	var wg sync.WaitGroup
+	responses := make([]*OptimizeResponse, len(widths))
+	for i, width := range widths {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], _ = is.Optimize(staleRequest(imageUrl, width, 0))
+		}()
+	}
+	// Release the origin once the second variant waits for the first one's request
+	for is.revalidations.Stats().Coalesced == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(block)
+	wg.Wait()
+
+	if gets := origin.gets(); gets != 1 {
+		t.Errorf("conditional requests = %d, want 1", gets)
+	}
+	for i, res := range responses {
+		if res == nil || !bytes.Equal(res.ImageData, modified) {
+			t.Errorf("width %d: response is not the modified image", widths[i])
+		}
+	}
+	// Neither revalidation purged the variant regenerated by the other one
+	for _, key := range []string{"80_4_0___original", params} {
+		if sourceDigest(t, db, repository.SourceHash(imageUrl)+"_"+key) != digest(modified) {
+			t.Errorf("%s not regenerated from the modified image", key)
+		}
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	is, db, origin, imageUrl := newRevalidationService(t)
+	original := optimize(t, is, optimizeRequest(imageUrl, "")).ImageData
+	modified := filledPNG(t, 255)
+	origin.update(func(o *revalidationOrigin) { o.data, o.etag = modified, `"v2"` })
+
+	res := optimize(t, is, staleRequest(imageUrl, 8, time.Hour))
+	if !res.Cache || !bytes.Equal(res.ImageData, original) {
+		t.Error("stale image not served while revalidating")
+	}
+	if err := is.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sourceDigest(t, db, repository.SourceHash(imageUrl)+"_"+params) != digest(modified) {
+		t.Error("stale image not regenerated in background")
+	}
+}
@@ -0,0 +1,35 @@
+package servicetest
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/patrickn2/go-image-optimizer/pkg/database"
+	"github.com/patrickn2/go-image-optimizer/pkg/imagecompress/imagecompresstest"
+	"github.com/patrickn2/go-image-optimizer/repository"
+	"github.com/patrickn2/go-image-optimizer/service"
+)
+
+// NewService serves the files from an origin server and returns an image
+// service with an in-memory cache and a passthrough compressor, and the
+// origin URL
+func NewService(t *testing.T, files map[string][]byte) (*service.ImageService, string) {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(origin.Close)
+
+	db := database.NewDatabaseInMemory(0, 0)
+	t.Cleanup(func() { db.Close() })
+	return service.NewImageService(imagecompresstest.Passthrough{}, repository.NewImageRepository(db, "in-memory"), origin.Client()), origin.URL
+}